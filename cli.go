@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/handler"
+	"github.com/coyove/fofou/server"
+)
+
+const cliUsage = `usage: fofou [flags] <command> [args...]
+
+The server must be stopped before running any command on the same data file.
+
+commands:
+  mod <op> <value> [reason]   perform a moderation operation, e.g.:
+                                mod lock 123
+                                mod block 1.2.0.0/16,24 spammer
+                                mod unblock 1.2.3.x
+                                mod max-live-topics 500
+                                mod title MyForum
+                                mod revoke *admin
+  sessions                    list issued privileged cookies
+  invite [max uses]           create an invite code for new users, 1 use by default
+  token <name,rate,scopes>    create an API token for bots, e.g.: token newsbot,60,topic,reply
+  config                      print the current forum config
+  passwd [totp]               read the new admin password from stdin, optionally
+                              enable TOTP as the second factor
+  rekey <new salt>            re-encrypt IPs and users of all posts with the new salt,
+                              then restart with: -s <new salt> -old-salts <old salt>
+`
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, cliUsage+"\nflags:\n")
+		flag.PrintDefaults()
+	}
+}
+
+// runCommand handles the offline subcommands, returns the exit code
+func runCommand(args []string) int {
+	if args[0] == "passwd" {
+		return runPasswd(len(args) > 1 && args[1] == "totp")
+	}
+
+	forum := common.Kforum
+	for !forum.IsReady() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	switch args[0] {
+	case "mod":
+		if len(args) < 3 {
+			break
+		}
+
+		if err := handler.Moderate(cliUser(), args[1], args[2], strings.Join(args[3:], " ")); err != nil {
+			fmt.Fprintf(os.Stderr, "%s=%s: %v\n", args[1], args[2], err)
+			return 1
+		}
+		fmt.Printf("%s=%s: done\n", args[1], args[2])
+		return 0
+	case "rekey":
+		if len(args) < 2 || args[1] == "" {
+			break
+		}
+		if err := forum.Rekey(server.MakeSalt(args[1])); err != nil {
+			fmt.Fprintln(os.Stderr, "rekey:", err)
+			return 1
+		}
+		fmt.Println("done, the old store has been backed up next to", common.DATA_MAIN)
+		return 0
+	case "invite":
+		uses := "1"
+		if len(args) > 1 {
+			uses = args[1]
+		}
+		code, err := handler.CreateInvite(cliUser(), uses, "")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invite:", err)
+			return 1
+		}
+		fmt.Println(code)
+		return 0
+	case "token":
+		if len(args) < 2 {
+			break
+		}
+		token, err := handler.CreateToken(cliUser(), args[1], "")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "token:", err)
+			return 1
+		}
+		fmt.Println(token)
+		return 0
+	case "sessions":
+		for _, s := range forum.GetSessions() {
+			fmt.Printf("%s,%d\tmask=%d role=%d issued=%s by=%s revoked=%v\n", s.IDName(), s.T, s.M, s.R, s.Date(), s.IssuerName(), s.Revoked)
+		}
+		return 0
+	case "config":
+		buf, _ := json.MarshalIndent(forum.ForumConfig, "", "  ")
+		fmt.Println(string(buf))
+		fmt.Println("max live topics:", forum.MaxLiveTopics())
+		return 0
+	}
+
+	fmt.Fprint(os.Stderr, cliUsage)
+	return 2
+}
+
+// operations performed offline are recorded as done by "cli"
+func cliUser() server.User {
+	u := server.User{M: 0xff}
+	copy(u.ID[:], "cli")
+	return u
+}
+
+func runPasswd(totp bool) int {
+	fmt.Fprint(os.Stderr, "new admin password: ")
+	password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if password = strings.TrimRight(password, "\r\n"); password == "" {
+		fmt.Fprintln(os.Stderr, "empty password")
+		return 1
+	}
+
+	cred := &server.AdminCredential{}
+	cred.SetPassword(password)
+	if totp {
+		cred.NewTOTPSecret()
+		fmt.Println("TOTP secret:", cred.TOTPSecret)
+		fmt.Println(cred.TOTPURI("fofou"))
+	}
+
+	if err := cred.Save(common.DATA_ADMIN); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("admin credential saved to", common.DATA_ADMIN+", restart the server to take effect")
+	return 0
+}
@@ -13,17 +13,22 @@ const (
 	DATA_LOGS      = "data/logs/"
 	DATA_MAIN      = "data/main.txt"
 	DATA_RECAPTCHA = "data/recaptcha.txt"
+	DATA_ADMIN     = "data/admin.txt"
+	DATA_WEBHOOKS  = "data/webhooks.txt"
+	DATA_DELIVERY  = "data/webhooks/"
 )
 
 var (
 	Kforum     *server.Forum
 	Kiq        *server.ImageQueue
+	Kwebhooks  *server.WebhookQueue
 	KthrotIPID *lru.Cache
 	KbadUsers  *lru.Cache
 	Kuuids     *lru.Cache
+	Kdups      *lru.Cache
 	Karchive   *lru.Cache
 	Kprod      bool
-	Kpassword  string
+	Kadmin     *server.AdminCredential
 	Kstart     time.Time
 )
 
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+type filterAction byte
+
+const (
+	filterPass filterAction = iota
+	filterSage
+	filterHold
+	filterReject
+)
+
+var filterActionNames = map[string]filterAction{
+	"sage":   filterSage,
+	"hold":   filterHold,
+	"reject": filterReject,
+}
+
+func (a filterAction) String() string {
+	for k, v := range filterActionNames {
+		if v == a {
+			return k
+		}
+	}
+	return "pass"
+}
+
+var rxLink = regexp.MustCompile(`https?://`)
+
+type filterInput struct {
+	Subject string
+	Message string
+	TopicID uint32
+	User    server.User
+}
+
+// postFilter inspects a post before it is stored, returns true if the post should be acted upon
+type postFilter interface {
+	Name() string
+	Check(in *filterInput) bool
+}
+
+type wordsFilter []*regexp.Regexp
+
+func (f wordsFilter) Name() string { return "words" }
+
+func (f wordsFilter) Check(in *filterInput) bool {
+	for _, rx := range f {
+		if rx.MatchString(in.Subject) || rx.MatchString(in.Message) {
+			return true
+		}
+	}
+	return false
+}
+
+type linksFilter struct{ maxLinks, newIDPosts int }
+
+func (f linksFilter) Name() string { return "links" }
+
+func (f linksFilter) Check(in *filterInput) bool {
+	if int(in.User.Posts) >= f.newIDPosts {
+		return false
+	}
+	return len(rxLink.FindAllStringIndex(in.Message, f.maxLinks+1)) > f.maxLinks
+}
+
+type dupFilter struct{ window int64 }
+
+func (f dupFilter) Name() string { return "duplicate" }
+
+func (f dupFilter) Check(in *filterInput) bool {
+	msg := strings.TrimSpace(in.Message)
+	if len(msg) < 16 {
+		// short messages like "+1" are duplicated all the time
+		return false
+	}
+
+	now := time.Now().Unix()
+	key := sha1.Sum([]byte(msg))
+	ts, ok := common.Kdups.Get(key)
+	common.Kdups.Add(key, now)
+	return ok && now-ts.(int64) < f.window
+}
+
+type refsFilter struct{ maxRefs int }
+
+func (f refsFilter) Name() string { return "refs" }
+
+func (f refsFilter) Check(in *filterInput) bool { return strings.Count(in.Message, ">>") > f.maxRefs }
+
+type filterRule struct {
+	postFilter
+	action filterAction
+}
+
+// compiledFilters holds the rules built from the forum config, they are rebuilt only when the config is changed
+var compiledFilters = struct {
+	sync.Mutex
+	rules []filterRule
+	ready bool
+}{}
+
+// currentFilters returns the compiled rules, building them from the loaded config on the first call
+func currentFilters() []filterRule {
+	compiledFilters.Lock()
+	defer compiledFilters.Unlock()
+	if !compiledFilters.ready {
+		rules, err := buildFilters(&common.Kforum.Filter)
+		if err != nil {
+			common.Kforum.Error("filter: %v", err)
+		}
+		compiledFilters.rules, compiledFilters.ready = rules, true
+	}
+	return compiledFilters.rules
+}
+
+// setFilters replaces the config and the compiled rules
+func setFilters(config server.FilterConfig, rules []filterRule) {
+	compiledFilters.Lock()
+	defer compiledFilters.Unlock()
+	common.Kforum.Filter = config
+	compiledFilters.rules, compiledFilters.ready = rules, true
+}
+
+// buildFilters compiles the config into rules, invalid words are skipped and reported by the error
+func buildFilters(config *server.FilterConfig) ([]filterRule, error) {
+	rules := make([]filterRule, 0, 4)
+	add := func(f postFilter, action string) {
+		if a := filterActionNames[action]; a != filterPass {
+			rules = append(rules, filterRule{f, a})
+		}
+	}
+
+	var err error
+	if len(config.Words) > 0 {
+		words := make(wordsFilter, 0, len(config.Words))
+		for _, w := range config.Words {
+			rx, rxErr := regexp.Compile(w)
+			if rxErr != nil {
+				err = fmt.Errorf("invalid filter word %q: %v", w, rxErr)
+				continue
+			}
+			words = append(words, rx)
+		}
+		add(words, config.WordsAction)
+	}
+	if config.NewIDPosts > 0 {
+		add(linksFilter{config.MaxLinks, config.NewIDPosts}, config.LinksAction)
+	}
+	if config.DupWindow > 0 {
+		add(dupFilter{int64(config.DupWindow)}, config.DupAction)
+	}
+	if config.MaxRefs > 0 {
+		add(refsFilter{config.MaxRefs}, config.RefsAction)
+	}
+	return rules, err
+}
+
+// runFilters returns the most severe action among all triggered filters
+func runFilters(rules []filterRule, in *filterInput) (filterAction, []string) {
+	action, names := filterPass, []string{}
+	for _, f := range rules {
+		if !f.Check(in) {
+			continue
+		}
+		names = append(names, f.Name())
+		if f.action > action {
+			action = f.action
+		}
+	}
+	return action, names
+}
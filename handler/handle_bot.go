@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+// tokenRates counts posts made by each API token in the current hour
+var tokenRates = struct {
+	sync.Mutex
+	m map[[8]byte]*tokenRate
+}{m: map[[8]byte]*tokenRate{}}
+
+type tokenRate struct {
+	start int64
+	n     int
+}
+
+// takeTokenRate returns 0 if the token can post now, or the seconds to wait
+func takeTokenRate(t server.APIToken) int64 {
+	if t.RateLimit == 0 {
+		return 0
+	}
+
+	tokenRates.Lock()
+	defer tokenRates.Unlock()
+
+	now := time.Now().Unix()
+	r := tokenRates.m[t.ID]
+	if r == nil || now-r.start >= 3600 {
+		r = &tokenRate{start: now}
+		tokenRates.m[t.ID] = r
+	}
+	if r.n >= int(t.RateLimit) {
+		return r.start + 3600 - now
+	}
+	r.n++
+	return 0
+}
+
+// url: /api/v1/posts, Authorization: Bearer TOKEN
+func BotAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeSimpleJSON(w, "success", false, "error", "invalid-token")
+		return
+	}
+
+	token, ok := common.Kforum.GetToken(strings.TrimSpace(auth[7:]))
+	if !ok || token.Revoked {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeSimpleJSON(w, "success", false, "error", "invalid-token")
+		return
+	}
+
+	var topic server.Topic
+	subject := strings.Replace(r.FormValue("subject"), "<", "&lt;", -1)
+	msg := r.FormValue("message")
+	topicID, _ := strconv.Atoi(strings.TrimSpace(r.FormValue("topic")))
+	if strings.HasPrefix(subject, "!!") {
+		topicID = 0
+	}
+
+	if topicID > 0 {
+		if topic = common.Kforum.Store.GetTopic(uint32(topicID), server.DefaultTopicMapper); topic.ID == 0 {
+			writeSimpleJSON(w, "success", false, "error", "bad-request")
+			return
+		}
+		if !token.Can(server.TOKEN_REPLY) {
+			w.WriteHeader(http.StatusForbidden)
+			writeSimpleJSON(w, "success", false, "error", "permission-denied")
+			return
+		}
+		if topic.Locked {
+			writeSimpleJSON(w, "success", false, "error", "topic-locked")
+			return
+		}
+	} else if !token.Can(server.TOKEN_TOPIC) {
+		w.WriteHeader(http.StatusForbidden)
+		writeSimpleJSON(w, "success", false, "error", "permission-denied")
+		return
+	}
+
+	if tmp := []rune(subject); len(tmp) > common.Kforum.MaxSubjectLen {
+		subject = string(tmp[:common.Kforum.MaxSubjectLen])
+	}
+	if len(msg) > common.Kforum.MaxMessageLen {
+		msg = msg[:common.Kforum.MaxMessageLen]
+	}
+	if len(msg) < common.Kforum.MinMessageLen {
+		writeSimpleJSON(w, "success", false, "error", "message-too-short")
+		return
+	}
+
+	// rate limited requests never reach the filters, so they are not recorded as duplicates
+	if wait := takeTokenRate(token); wait > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(wait, 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+		writeSimpleJSON(w, "success", false, "error", "rate-limited", "retry_after", wait)
+		return
+	}
+
+	// the token acts as a normal user, so it goes through the same bans, sanitising and filters
+	ipAddr := getIPAddress(r)
+	draft := postDraft{
+		User:    server.User{ID: token.User, T: int64(token.CreatedAt)},
+		IP:      ipAddr,
+		TopicID: topic.ID,
+		Subject: subject,
+		Message: msg,
+		Sage:    r.FormValue("sage") == "1",
+	}
+	if !checkPost(w, &draft) {
+		return
+	}
+
+	var postLongID uint64
+	var err error
+	if topicID == 0 {
+		postLongID, err = common.Kforum.Store.NewTopic(subject, draft.Message, nil, nil, token.User, ipAddr, draft.Sage, draft.Pending)
+	} else {
+		postLongID, err = common.Kforum.Store.NewPost(topic.ID, draft.Message, nil, nil, token.User, ipAddr, draft.Sage, draft.Pending)
+	}
+	if err != nil {
+		common.Kforum.Error("token %s failed to post to %d: %v", token.IDString(), topicID, err)
+		writeSimpleJSON(w, "success", false, "error", "internal-error")
+		return
+	}
+
+	common.Kforum.Notice("token %s (%s) has posted %d", token.IDString(), token.UserName(), postLongID)
+	if !draft.Pending {
+		firePostWebhook(postLongID)
+	}
+
+	tmpt, tmpp := server.SplitID(postLongID)
+	writeSimpleJSON(w, "success", true, "topic", tmpt, "post", tmpp, "longid", postLongID, "pending", draft.Pending)
+}
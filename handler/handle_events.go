@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+const eventsHeartbeat = 30 * time.Second
+
+// url: /api/v1/events?topic=ID, server-sent events of the topic, or of all topics if ID is omitted,
+// it is served without preHandle because the connection stays open
+func Events(w http.ResponseWriter, r *http.Request) {
+	if !common.Kforum.IsReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	topicID, _ := strconv.ParseUint(r.FormValue("topic"), 10, 32)
+	if topicID > 0 {
+		u := common.Kforum.GetUser(r)
+		topic := common.Kforum.Store.GetTopic(uint32(topicID), server.DefaultTopicMapper)
+		if topic.ID == 0 || !topic.IsVisibleTo(u.ID, u.CanModerate()) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	sub, err := common.Kforum.Subscribe(uint32(topicID))
+	if err != nil {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer common.Kforum.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				// the client is too slow to keep up, it should reload the page
+				fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			buf, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, buf); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
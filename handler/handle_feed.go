@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+const feedSize = 20
+
+// feed is the format-independent content of RSS, Atom and JSON feeds
+type feed struct {
+	Title   string
+	Link    string
+	Self    string
+	Updated time.Time
+	Items   []feedItem
+}
+
+type feedItem struct {
+	ID        string
+	Title     string
+	Link      string
+	Author    string
+	Content   string // HTML
+	Published time.Time
+	Updated   time.Time
+}
+
+func feedPostItem(subject string, p *server.Post) feedItem {
+	link := fmt.Sprintf("%s/p/%d", common.Kforum.URL, p.LongID())
+	t := time.Unix(int64(p.CreatedAt), 0)
+	item := feedItem{ID: link, Title: subject, Link: link, Author: p.PublicName(), Published: t, Updated: t}
+	if !p.IsDeleted() {
+		item.Content = p.MessageHTML()
+	}
+	if item.Author == "" {
+		item.Author = "anonymous"
+	}
+	return item
+}
+
+// url: /rss.xml, /atom.xml and /feed.json, ?topic=ID for replies of the topic, ?tagged=1 for !! topics
+func Feed(w http.ResponseWriter, r *http.Request) {
+	f := feed{
+		Title:   common.Kforum.Title,
+		Link:    common.Kforum.URL + "/",
+		Self:    common.Kforum.URL + r.URL.RequestURI(),
+		Updated: time.Unix(0, 0),
+	}
+
+	if topicID, _ := strconv.Atoi(r.FormValue("topic")); topicID > 0 {
+		topic := common.Kforum.Store.GetTopic(uint32(topicID), server.DefaultTopicMapper)
+		if topic.ID == 0 || !topic.IsVisibleTo([8]byte{}, false) {
+			w.WriteHeader(404)
+			return
+		}
+
+		subject := html.UnescapeString(topic.Subject)
+		f.Title = fmt.Sprintf("%s - No.%d %s", common.Kforum.Title, topic.ID, subject)
+		f.Link = fmt.Sprintf("%s/t/%d", common.Kforum.URL, topic.ID)
+		f.Updated = time.Unix(int64(topic.ModifiedAt), 0)
+		for i := len(topic.Posts) - 1; i >= 0 && len(f.Items) < feedSize; i-- {
+			p := &topic.Posts[i]
+			if p.IsPending() || p.IsDeleted() {
+				continue
+			}
+			title := subject
+			if i > 0 {
+				title = fmt.Sprintf("Re: %s #%d", subject, p.ID)
+			}
+			f.Items = append(f.Items, feedPostItem(title, p))
+		}
+	} else {
+		filter := common.TopicFilter1
+		if r.FormValue("tagged") != "" {
+			filter = common.TopicFilter2
+			f.Title += " - !!"
+			f.Link = common.Kforum.URL + "/tagged"
+		}
+
+		topics := common.Kforum.GetTopics(0, feedSize, func(t *server.Topic) bool {
+			return filter(t) && t.IsVisibleTo([8]byte{}, false)
+		}, server.DefaultTopicMapper)
+		for i := range topics {
+			t := &topics[i]
+			if len(t.Posts) == 0 {
+				continue
+			}
+			item := feedPostItem(html.UnescapeString(t.Subject), &t.Posts[0])
+			item.ID, item.Link = fmt.Sprintf("%s/t/%d", common.Kforum.URL, t.ID), fmt.Sprintf("%s/t/%d", common.Kforum.URL, t.ID)
+			item.Updated = time.Unix(int64(t.ModifiedAt), 0)
+			if item.Updated.After(f.Updated) {
+				f.Updated = item.Updated
+			}
+			f.Items = append(f.Items, item)
+		}
+	}
+
+	var buf []byte
+	var contentType string
+	switch {
+	case strings.HasSuffix(r.URL.Path, ".json"):
+		buf, contentType = f.jsonFeed(), "application/feed+json; charset=utf-8"
+	case strings.HasPrefix(r.URL.Path, "/atom"):
+		buf, contentType = f.atom(), "application/atom+xml; charset=utf-8"
+	default:
+		buf, contentType = f.rss(), "application/rss+xml; charset=utf-8"
+	}
+
+	// conditional GET, ETag takes precedence over Last-Modified
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(buf))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", f.Updated.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if strings.Contains(match, etag) || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !f.Updated.Truncate(time.Second).After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf)
+}
+
+func (f *feed) rss() []byte {
+	type item struct {
+		Title       string `xml:"title"`
+		Link        string `xml:"link"`
+		GUID        string `xml:"guid"`
+		PubDate     string `xml:"pubDate"`
+		Description string `xml:"description"`
+	}
+	v := struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Title   string   `xml:"channel>title"`
+		Link    string   `xml:"channel>link"`
+		Desc    string   `xml:"channel>description"`
+		PubDate string   `xml:"channel>pubDate"`
+		Items   []item   `xml:"channel>item"`
+	}{Version: "2.0", Title: f.Title, Link: f.Link, Desc: f.Title, PubDate: f.Updated.Format(time.RFC1123Z)}
+
+	for _, it := range f.Items {
+		v.Items = append(v.Items, item{
+			Title:       it.Title,
+			Link:        it.Link,
+			GUID:        it.ID,
+			PubDate:     it.Published.Format(time.RFC1123Z),
+			Description: it.Content,
+		})
+	}
+	buf, _ := xml.Marshal(v)
+	return append([]byte(xml.Header), buf...)
+}
+
+func (f *feed) atom() []byte {
+	type link struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr,omitempty"`
+	}
+	type content struct {
+		Type string `xml:"type,attr"`
+		Body string `xml:",chardata"`
+	}
+	type entry struct {
+		Title     string  `xml:"title"`
+		ID        string  `xml:"id"`
+		Link      link    `xml:"link"`
+		Published string  `xml:"published"`
+		Updated   string  `xml:"updated"`
+		Author    string  `xml:"author>name"`
+		Content   content `xml:"content"`
+	}
+	v := struct {
+		XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+		Title   string   `xml:"title"`
+		ID      string   `xml:"id"`
+		Updated string   `xml:"updated"`
+		Links   []link   `xml:"link"`
+		Entries []entry  `xml:"entry"`
+	}{
+		Title:   f.Title,
+		ID:      f.Self,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links:   []link{{Href: f.Link}, {Href: f.Self, Rel: "self"}},
+	}
+
+	for _, it := range f.Items {
+		v.Entries = append(v.Entries, entry{
+			Title:     it.Title,
+			ID:        it.ID,
+			Link:      link{Href: it.Link},
+			Published: it.Published.UTC().Format(time.RFC3339),
+			Updated:   it.Updated.UTC().Format(time.RFC3339),
+			Author:    it.Author,
+			Content:   content{Type: "html", Body: it.Content},
+		})
+	}
+	buf, _ := xml.Marshal(v)
+	return append([]byte(xml.Header), buf...)
+}
+
+// jsonFeed follows https://jsonfeed.org/version/1.1
+func (f *feed) jsonFeed() []byte {
+	type author struct {
+		Name string `json:"name"`
+	}
+	type item struct {
+		ID            string   `json:"id"`
+		URL           string   `json:"url"`
+		Title         string   `json:"title"`
+		ContentHTML   string   `json:"content_html"`
+		DatePublished string   `json:"date_published"`
+		DateModified  string   `json:"date_modified"`
+		Authors       []author `json:"authors"`
+	}
+	v := struct {
+		Version     string `json:"version"`
+		Title       string `json:"title"`
+		HomePageURL string `json:"home_page_url"`
+		FeedURL     string `json:"feed_url"`
+		Items       []item `json:"items"`
+	}{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.Self,
+		Items:       []item{},
+	}
+
+	for _, it := range f.Items {
+		v.Items = append(v.Items, item{
+			ID:            it.ID,
+			URL:           it.Link,
+			Title:         it.Title,
+			ContentHTML:   it.Content,
+			DatePublished: it.Published.UTC().Format(time.RFC3339),
+			DateModified:  it.Updated.UTC().Format(time.RFC3339),
+			Authors:       []author{{it.Author}},
+		})
+	}
+	buf, _ := json.Marshal(v)
+	return buf
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+// the time when the inbox was read last time is kept in the cookie
+const inboxCookie = "inbox"
+
+// url: /inbox
+func Inbox(w http.ResponseWriter, r *http.Request) {
+	u := common.Kforum.GetUser(r)
+	model := struct {
+		server.Forum
+		server.Topic
+		IsValid bool
+	}{Forum: *common.Kforum, IsValid: u.IsValid()}
+
+	if model.IsValid {
+		posts := common.Kforum.GetInbox(u.ID)
+		for i := range posts {
+			posts[i].T_SetStatus(server.POST_T_ISREF)
+		}
+		model.Topic = server.Topic{Posts: posts}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:    inboxCookie,
+			Value:   strconv.FormatInt(time.Now().Unix(), 10),
+			Path:    "/",
+			Expires: time.Now().AddDate(1, 0, 0),
+		})
+	}
+
+	server.Render(w, server.TmplInbox, model)
+}
+
+// url: /api/inbox
+func InboxAPI(w http.ResponseWriter, r *http.Request) {
+	u := common.Kforum.GetUser(r)
+	if !u.IsValid() {
+		writeSimpleJSON(w, "success", true, "unread", 0)
+		return
+	}
+
+	var since int64
+	if c, err := r.Cookie(inboxCookie); err == nil {
+		since, _ = strconv.ParseInt(c.Value, 10, 64)
+	}
+	writeSimpleJSON(w, "success", true, "unread", common.Kforum.CountInbox(u.ID, uint32(since)))
+}
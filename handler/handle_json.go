@@ -0,0 +1,332 @@
+package handler
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+// JSON API, field names are part of the API and should never be changed,
+// cursors are opaque strings, an empty "next" means there is no more data
+
+const apiMaxLimit = 100
+
+type apiImage struct {
+	URL    string `json:"url"`
+	Thumb  string `json:"thumb"`
+	Name   string `json:"name"`
+	Size   uint32 `json:"size"`
+	Width  uint16 `json:"width"`
+	Height uint16 `json:"height"`
+}
+
+type apiTrip struct {
+	Name string `json:"name"`
+	Code string `json:"code"`
+}
+
+type apiPost struct {
+	LongID    uint64    `json:"longid"`
+	Topic     uint32    `json:"topic"`
+	Post      uint16    `json:"post"`
+	CreatedAt uint32    `json:"created_at"`
+	User      string    `json:"user,omitempty"`
+	Trip      *apiTrip  `json:"trip,omitempty"`
+	Message   string    `json:"message"`
+	HTML      string    `json:"html"`
+	Image     *apiImage `json:"image,omitempty"`
+	OP        bool      `json:"op"`
+	You       bool      `json:"you"`
+	Sage      bool      `json:"sage"`
+	NSFW      bool      `json:"nsfw"`
+	Deleted   bool      `json:"deleted"`
+	Pending   bool      `json:"pending"`
+}
+
+type apiTopic struct {
+	ID         uint32    `json:"id"`
+	Subject    string    `json:"subject"`
+	CreatedAt  uint32    `json:"created_at"`
+	ModifiedAt uint32    `json:"modified_at"`
+	Replies    int       `json:"replies"`
+	Sticky     bool      `json:"sticky"`
+	Locked     bool      `json:"locked"`
+	Saged      bool      `json:"saged"`
+	Archived   bool      `json:"archived"`
+	FreeReply  bool      `json:"free_reply"`
+	Posts      []apiPost `json:"posts"`
+}
+
+// apiOptions is what affects how posts are presented to the requester
+type apiOptions struct {
+	User    server.User
+	IsAdmin bool
+	NSFW    bool // include NSFW images
+}
+
+func getAPIOptions(r *http.Request) apiOptions {
+	u := common.Kforum.GetUser(r)
+	return apiOptions{User: u, IsAdmin: u.CanModerate(), NSFW: r.FormValue("nsfw") == "1"}
+}
+
+func getAPILimit(r *http.Request, def int) int {
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit <= 0 {
+		return def
+	}
+	return intmin(limit, apiMaxLimit)
+}
+
+// p.Topic should have been reparented
+func (o apiOptions) post(p *server.Post) apiPost {
+	topicID, postID := server.SplitID(p.LongID())
+	ap := apiPost{
+		LongID:    p.LongID(),
+		Topic:     topicID,
+		Post:      postID,
+		CreatedAt: p.CreatedAt,
+		OP:        p.T_IsOP(),
+		You:       p.T_IsYou(),
+		Sage:      p.IsSaged(),
+		NSFW:      p.T_IsNSFW(),
+		Deleted:   p.IsDeleted(),
+		Pending:   p.IsPending(),
+	}
+
+	if ap.Deleted && !o.IsAdmin {
+		return ap
+	}
+
+	if o.IsAdmin {
+		ap.User = p.User()
+	} else {
+		ap.User = p.PublicName()
+	}
+	if p.Trip != nil {
+		ap.Trip = &apiTrip{Name: p.Trip.Name, Code: p.Trip.Code}
+	}
+	ap.Message, ap.HTML = p.Message, p.MessageHTML()
+	if p.Image != nil && (!ap.NSFW || o.NSFW) {
+		url := fmt.Sprintf("%s/i/%s", common.Kforum.URL, p.Image.Path)
+		ap.Image = &apiImage{
+			URL:    url,
+			Thumb:  url + "?thumb=1",
+			Name:   p.Image.Name,
+			Size:   p.Image.Size,
+			Width:  p.Image.X,
+			Height: p.Image.Y,
+		}
+	}
+	return ap
+}
+
+func (o apiOptions) topic(t *server.Topic, posts []server.Post) apiTopic {
+	at := apiTopic{
+		ID:         t.ID,
+		Subject:    html.UnescapeString(t.Subject),
+		CreatedAt:  t.CreatedAt,
+		ModifiedAt: t.ModifiedAt,
+		Replies:    len(t.Posts) - 1,
+		Sticky:     t.Sticky,
+		Locked:     t.Locked,
+		Saged:      t.Saged,
+		Archived:   t.Archived,
+		FreeReply:  t.FreeReply,
+		Posts:      []apiPost{},
+	}
+	for i := range posts {
+		at.Posts = append(at.Posts, o.post(&posts[i]))
+	}
+	return at
+}
+
+// getAnyTopic returns the live or archived topic
+func getAnyTopic(topicID uint32) (server.Topic, bool) {
+	topic := common.Kforum.Store.GetTopic(topicID, server.DefaultTopicMapper)
+	if topic.ID != 0 {
+		return topic, true
+	}
+	if i, ok := common.Karchive.Get(int(topicID)); ok {
+		return i.(server.Topic), true
+	}
+	topic, err := common.Kforum.LoadArchivedTopic(topicID, common.Kforum.Salt)
+	if err != nil {
+		return topic, false
+	}
+	topic.Archived = true
+	common.Karchive.Add(int(topicID), topic)
+	return topic, true
+}
+
+// url: /api/v1/topics?tagged=1&after=CURSOR&limit=N
+func APITopics(w http.ResponseWriter, r *http.Request) {
+	o := getAPIOptions(r)
+	limit := getAPILimit(r, common.Kforum.TopicsPerPage)
+	filter := common.TopicFilter1
+	if r.FormValue("tagged") != "" {
+		filter = common.TopicFilter2
+	}
+
+	// the cursor is "ID-ACTIVE" of the last topic, topics bumped since then may appear again,
+	// if that topic has been archived or purged, continue from the first topic which was active before it
+	after, active := parseTopicsCursor(r.FormValue("after"))
+	found := after == 0
+	gone := !found && common.Kforum.GetTopic(after, func(t *server.Topic) server.Topic { return server.Topic{ID: t.ID} }).ID == 0
+
+	topics := common.Kforum.GetTopics(0, limit, func(t *server.Topic) bool {
+		if !found && gone {
+			found = !t.Sticky && topicActiveAt(t) < active
+		}
+		if !found {
+			found = t.ID == after
+			return false
+		}
+		return filter(t) && t.IsVisibleTo(o.User.ID, o.IsAdmin)
+	}, func(topic *server.Topic) server.Topic {
+		t := *topic
+		t.Posts = append([]server.Post{}, t.Posts...)
+		t.Reparent(o.User.ID)
+		return t
+	})
+
+	res := []apiTopic{}
+	for i := range topics {
+		t := &topics[i]
+		// the first post and the last 4 replies, like the front page
+		posts := t.Posts
+		if len(posts) > 5 {
+			posts = append([]server.Post{posts[0]}, posts[len(posts)-4:]...)
+		}
+		tmp := server.Topic{Posts: posts}
+		tmp.HidePending(o.IsAdmin)
+		res = append(res, o.topic(t, tmp.Posts))
+	}
+
+	next := ""
+	if len(topics) == limit {
+		t := &topics[len(topics)-1]
+		next = fmt.Sprintf("%d-%d", t.ID, topicActiveAt(t))
+	}
+	writeSimpleJSON(w, "success", true, "topics", res, "next", next)
+}
+
+func topicActiveAt(t *server.Topic) uint32 {
+	if t.ModifiedAt == 0 {
+		return t.CreatedAt
+	}
+	return t.ModifiedAt
+}
+
+func parseTopicsCursor(cursor string) (uint32, uint32) {
+	parts := strings.SplitN(cursor, "-", 2)
+	id, _ := strconv.ParseUint(parts[0], 10, 32)
+	if len(parts) < 2 {
+		return uint32(id), 0
+	}
+	active, _ := strconv.ParseUint(parts[1], 10, 32)
+	return uint32(id), uint32(active)
+}
+
+// url: /api/v1/topic/{tid}?after=CURSOR&limit=N
+func APITopic(w http.ResponseWriter, r *http.Request) {
+	o := getAPIOptions(r)
+	topicID, _ := strconv.ParseUint(r.URL.Path[len("/api/v1/topic/"):], 10, 32)
+	topic, ok := getAnyTopic(uint32(topicID))
+	if !ok || len(topic.Posts) == 0 || !topic.IsVisibleTo(o.User.ID, o.IsAdmin) {
+		writeSimpleJSON(w, "success", false, "error", "not-found")
+		return
+	}
+
+	topic.Posts = append([]server.Post{}, topic.Posts...)
+	topic.Reparent(o.User.ID)
+
+	// the cursor is the ID of the last post
+	limit := getAPILimit(r, common.Kforum.PostsPerPage)
+	after, _ := strconv.Atoi(r.FormValue("after"))
+	if after < 0 || after > len(topic.Posts) {
+		after = len(topic.Posts)
+	}
+
+	posts := topic.Posts[after:intmin(after+limit, len(topic.Posts))]
+	next := ""
+	if after+len(posts) < len(topic.Posts) {
+		next = strconv.Itoa(after + len(posts))
+	}
+
+	tmp := server.Topic{Posts: posts}
+	tmp.HidePending(o.IsAdmin)
+	writeSimpleJSON(w, "success", true, "topic", o.topic(&topic, tmp.Posts), "next", next)
+}
+
+// url: /api/v1/post/{longid}
+func APIPost(w http.ResponseWriter, r *http.Request) {
+	o := getAPIOptions(r)
+	longID, _ := strconv.ParseUint(r.URL.Path[len("/api/v1/post/"):], 10, 64)
+	topicID, postID := server.SplitID(longID)
+	topic, ok := getAnyTopic(topicID)
+	if !ok || postID == 0 || int(postID) > len(topic.Posts) || !topic.IsVisibleTo(o.User.ID, o.IsAdmin) {
+		writeSimpleJSON(w, "success", false, "error", "not-found")
+		return
+	}
+
+	topic.Posts = append([]server.Post{}, topic.Posts...)
+	topic.Reparent(o.User.ID)
+	p := &topic.Posts[postID-1]
+	if p.IsPending() && !p.T_IsYou() && !o.IsAdmin {
+		writeSimpleJSON(w, "success", false, "error", "not-found")
+		return
+	}
+	writeSimpleJSON(w, "success", true, "post", o.post(p))
+}
+
+// url: /api/v1/search?q=ID&qt=TEXT&after=CURSOR&limit=N, same as /list
+func APISearch(w http.ResponseWriter, r *http.Request) {
+	o := getAPIOptions(r)
+	q, qt := r.FormValue("q"), r.FormValue("qt")
+	if q == "" && qt == "" {
+		writeSimpleJSON(w, "success", false, "error", "bad-request")
+		return
+	}
+
+	query := server.Parse8Bytes(q)
+	if !o.IsAdmin && q != "" && query != o.User.ID {
+		// non admin can only query himself
+		writeSimpleJSON(w, "success", false, "error", "permission-denied")
+		return
+	}
+
+	// the cursor is the number of results returned so far
+	limit := getAPILimit(r, 50)
+	after, _ := strconv.Atoi(r.FormValue("after"))
+	if after < 0 {
+		after = 0
+	}
+
+	posts, total := common.Kforum.GetPostsBy(query, qt, after+limit, int64(common.Kforum.SearchTimeout)*1e6)
+	if after > len(posts) {
+		after = len(posts)
+	}
+
+	res := []apiPost{}
+	for i := range posts[after:] {
+		p := &posts[after+i]
+		if p.UserXor() == o.User.ID {
+			p.T_SetStatus(server.POST_T_ISYOU)
+		}
+		if p.IsPending() && !p.T_IsYou() && !o.IsAdmin {
+			continue
+		}
+		res = append(res, o.post(p))
+	}
+
+	next := ""
+	if after+limit < total && len(posts) == after+limit {
+		next = strconv.Itoa(after + limit)
+	}
+	writeSimpleJSON(w, "success", true, "posts", res, "total", total, "next", next)
+}
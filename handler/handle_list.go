@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/coyove/fofou/common"
 	"github.com/coyove/fofou/server"
@@ -26,6 +25,7 @@ func List(w http.ResponseWriter, r *http.Request) {
 		QueryText  string
 		Blocked    map[string]bool
 		IsBlocked  bool
+		Ban        server.Ban
 	}{Forum: *common.Kforum}
 
 	if q == "" && qt == "" {
@@ -51,10 +51,16 @@ func List(w http.ResponseWriter, r *http.Request) {
 	}
 
 	posts, total := store.GetPostsBy(query, qt, maxTopics, int64(common.Kforum.SearchTimeout)*1e6)
-	isBlocked := store.IsBlocked(query)
+	ban, isBlocked := store.GetBan(query)
+	if strings.HasSuffix(q, "x") {
+		ban, isBlocked = store.GetIPBan(query)
+	}
 
 	for i := range posts {
 		posts[i].T_SetStatus(server.POST_T_ISREF)
+		if posts[i].UserXor() == user.ID {
+			posts[i].T_SetStatus(server.POST_T_ISYOU)
+		}
 	}
 
 	model.Topic = server.Topic{
@@ -62,43 +68,13 @@ func List(w http.ResponseWriter, r *http.Request) {
 		Subject:   fmt.Sprintf("%s: %x", q, query),
 		T_IsAdmin: isAdmin,
 	}
+	model.Topic.HidePending(isAdmin)
 	model.TotalCount = total
 	model.IsAdmin = isAdmin
 	model.IsBlocked = isBlocked
+	model.Ban = ban
 	model.Query = q
 	model.QueryText = qt
 
 	server.Render(w, server.TmplPosts, model)
 }
-
-func RSS(w http.ResponseWriter, r *http.Request) {
-	xml := []string{
-		`<?xml version="1.0" encoding="UTF-8"?>`,
-		`<rss version="2.0"><channel>`,
-		`<title>`, common.Kforum.Title, `</title>`,
-		`<pubDate>`, time.Now().Format(time.RFC1123Z), `</pubDate>`,
-		`<link>`, common.Kforum.URL, `</link>`,
-	}
-
-	topics := common.Kforum.GetTopics(0, 20, common.TopicFilter1, server.DefaultTopicMapper)
-	for _, g := range topics {
-		var message string
-		if len(g.Posts) > 0 {
-			message = g.Posts[0].MessageHTML()
-		}
-
-		xml = append(xml,
-			`<item>`,
-			`<title>`, g.Subject, `</title>`,
-			`<pubDate>`, time.Unix(int64(g.CreatedAt), 0).Format(time.RFC1123Z), `</pubDate>`,
-			`<link>`, common.Kforum.URL, "/t/", strconv.FormatUint(uint64(g.ID), 10), `</link>`,
-			`<description>`, `<![CDATA[`, message, `]]>`, `</description>`,
-			`</item>`,
-		)
-	}
-
-	xml = append(xml, "</channel></rss>")
-
-	w.Header().Add("Content-Type", "application/xml")
-	w.Write([]byte(strings.Join(xml, "")))
-}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+// url: /members
+func Members(w http.ResponseWriter, r *http.Request) {
+	model := struct {
+		server.Forum
+		Members []server.Member
+	}{
+		Forum:   *common.Kforum,
+		Members: common.Kforum.GetMembers(false),
+	}
+	server.Render(w, server.TmplMembers, model)
+}
+
+// url: /api/name
+func NameAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.Referer(), common.Kforum.URL) && common.Kprod {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ipAddr, u := getIPAddress(r), common.Kforum.GetUser(r)
+	if !u.IsValid() || !throtNewPost(ipAddr, u.ID) {
+		writeSimpleJSON(w, "success", false, "error", "bad-request")
+		return
+	}
+
+	if ban, ok := common.Kforum.Store.GetBan(u.ID); ok {
+		writeBanned(w, ban)
+		return
+	}
+
+	if err := common.Kforum.RequestName(u.ID, strings.TrimSpace(r.FormValue("name"))); err != nil {
+		writeSimpleJSON(w, "success", false, "error", "invalid-name", "message", err.Error())
+		return
+	}
+	writeSimpleJSON(w, "success", true)
+}
@@ -22,6 +22,64 @@ import (
 
 var rxImageExts = regexp.MustCompile(`(?i)(\.png|\.jpg|\.jpeg|\.gif|\.svg)$`)
 
+// postDraft is a post about to be stored, either from PostAPI or BotAPI
+type postDraft struct {
+	User    server.User
+	IP      [8]byte
+	TopicID uint32
+	Subject string
+	Message string
+	Sage    bool
+	Pending bool
+}
+
+// checkPost runs the checks shared by all ways of posting: bans, sanitising and filters,
+// it writes the error and returns false if the post should not be stored
+func checkPost(w http.ResponseWriter, d *postDraft) bool {
+	if !d.User.Can(server.CAP_ADMIN) {
+		if ban, ok := common.Kforum.Store.GetIPBan(d.IP); ok {
+			common.Kforum.Notice("blocked a post from IP: %v", d.IP)
+			writeBanned(w, ban)
+			return false
+		}
+		if ban, ok := common.Kforum.Store.GetBan(d.User.ID); ok {
+			common.Kforum.Notice("blocked a post from user %v", d.User.ID)
+			writeBanned(w, ban)
+			return false
+		}
+		// raw HTML blocks are for admins only
+		if strings.Contains(d.Message, "```") {
+			d.Message = reMessage.ReplaceAllString(d.Message, "```")
+		}
+	}
+
+	if d.User.CanModerate() {
+		return true
+	}
+
+	action, names := runFilters(currentFilters(), &filterInput{
+		Subject: d.Subject,
+		Message: d.Message,
+		TopicID: d.TopicID,
+		User:    d.User,
+	})
+	if action != filterPass {
+		_, username := server.Format8Bytes(d.User.ID)
+		ipstr, _ := server.Format8Bytes(d.IP)
+		common.Kforum.Notice("filter %v: %v post from %s (%s) to %d", names, action, username, ipstr, d.TopicID)
+	}
+	switch action {
+	case filterReject:
+		writeSimpleJSON(w, "success", false, "error", "filtered")
+		return false
+	case filterHold:
+		d.Pending = true
+	case filterSage:
+		d.Sage = true
+	}
+	return true
+}
+
 func PostAPI(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, int64(common.Kforum.MaxImageSize)*1024*1024)
 
@@ -46,21 +104,9 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 
 	ipAddr, user := getIPAddress(r), common.Kforum.GetUser(r)
 
-	if !user.Can(server.PERM_ADMIN) {
-		if common.Kforum.Store.IsBlocked(ipAddr) {
-			common.Kforum.Notice("blocked a post from IP: %v", ipAddr)
-			badRequest()
-			return
-		}
-		if common.Kforum.Store.IsBlocked(user.ID) {
-			common.Kforum.Notice("blocked a post from user %v", user.ID)
-			badRequest()
-			return
-		}
-		if !user.CanModerate() && !throtNewPost(ipAddr, user.ID) {
-			badRequest()
-			return
-		}
+	if !user.CanModerate() && !throtNewPost(ipAddr, user.ID) {
+		badRequest()
+		return
 	}
 
 	if !strings.HasPrefix(r.Referer(), common.Kforum.URL) && common.Kprod {
@@ -75,6 +121,7 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 		}
 		copy(user.ID[2:], common.Kforum.Rand.Fetch(6))
 		user.T = time.Now().Unix()
+		user.CreatedAt = user.T
 		if topic.ID == 0 {
 			user.N = uint32(common.Kforum.Rand.Intn(10) + 10)
 		} else {
@@ -83,13 +130,13 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// if user didn't pass the dice test, we will challenge him/her
-	if false && !user.Can(server.PERM_NO_ROLL) && !user.PassRoll() {
+	if false && !user.Can(server.CAP_NO_ROLL) && !user.PassRoll() {
 		_testCount, _ := common.KbadUsers.Get(user.ID)
 		testCount, _ := _testCount.(int)
 		if testCount++; testCount > 10 {
 			common.KbadUsers.Remove(user.ID)
-			common.Kforum.Block(user.ID)
-			common.Kforum.Block(ipAddr)
+			common.Kforum.Ban(user.ID, [8]byte{}, 0, "recaptcha")
+			common.Kforum.Ban(ipAddr, [8]byte{}, 0, "recaptcha")
 			badRequest()
 			return
 		}
@@ -132,24 +179,12 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 	sage := strings.Contains(options, "sage")
 	nsfw := strings.Contains(options, "nsfw")
 	nocookie := strings.Contains(options, "nocookie")
+	trip := server.MakeTripcode(r.FormValue("name"), common.Kforum.Salt)
 
 	if strings.HasPrefix(subject, "!!") {
 		topic.ID = 0
 	}
 
-	// validate the fields
-	if !user.Can(server.PERM_ADMIN) && strings.Contains(msg, "```") {
-		msg = reMessage.ReplaceAllString(msg, "```")
-	}
-
-	if modCode(common.Kforum, user, subject, msg) {
-		_, username := server.Format8Bytes(user.ID)
-		ipstr, _ := server.Format8Bytes(ipAddr)
-		common.Kforum.Notice("mod %s from %s has performed: %s", username, ipstr, msg)
-		writeSimpleJSON(w, "success", true, "mod-operation", msg)
-		return
-	}
-
 	// simple mechanism to prevent double post only
 	uuid := server.DecodeUUID(r.FormValue("uuid"))
 	if _, existed := common.Kuuids.Get(uuid); existed {
@@ -195,6 +230,18 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	draft := postDraft{User: user, IP: ipAddr, TopicID: topic.ID, Subject: subject, Message: msg, Sage: sage}
+	if !checkPost(w, &draft) {
+		return
+	}
+	msg, sage, pending := draft.Message, draft.Sage, draft.Pending
+
+	if !pending && common.Kforum.NeedsPremod(user) {
+		_, username := server.Format8Bytes(user.ID)
+		common.Kforum.Notice("premod: hold post from new ID %s to %d", username, topic.ID)
+		pending = true
+	}
+
 	if !nocookie {
 		common.Kforum.SetUser(w, user)
 	}
@@ -229,7 +276,7 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 
 	var postLongID uint64
 	if topic.ID == 0 {
-		postLongID, err = common.Kforum.Store.NewTopic(subject, msg, aImage, user.ID, ipAddr, sage)
+		postLongID, err = common.Kforum.Store.NewTopic(subject, msg, aImage, trip, user.ID, ipAddr, sage, pending)
 		if err != nil {
 			common.Kforum.Error("failed to create new topic: %v", err)
 			internalError()
@@ -248,7 +295,7 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 			}()
 		}
 	} else {
-		postLongID, err = common.Kforum.Store.NewPost(topic.ID, msg, aImage, user.ID, ipAddr, sage)
+		postLongID, err = common.Kforum.Store.NewPost(topic.ID, msg, aImage, trip, user.ID, ipAddr, sage, pending)
 		if err != nil {
 			common.Kforum.Error("failed to create new post to %d: %v", topic.ID, err)
 			internalError()
@@ -256,6 +303,10 @@ func PostAPI(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if !pending {
+		firePostWebhook(postLongID)
+	}
+
 	tmpt, tmpp := server.SplitID(postLongID)
-	writeSimpleJSON(w, "success", true, "topic", tmpt, "post", tmpp, "longid", postLongID)
+	writeSimpleJSON(w, "success", true, "topic", tmpt, "post", tmpp, "longid", postLongID, "pending", pending)
 }
@@ -72,13 +72,21 @@ NEXT:
 	}
 	topic.Posts[0].T_SetStatus(server.POST_T_ISFIRST)
 	topic.Reparent(user.ID)
+	topic.HidePending(isAdmin)
+	if len(topic.Posts) == 0 || !topic.Posts[0].T_IsFirst() {
+		// the first post is pending and invisible to the user
+		http.Redirect(w, r, "/", 302)
+		return
+	}
 
 	model := struct {
 		server.Forum
 		server.Topic
 		newPostInfo
-		Pages   int
-		CurPage int
+		Pages    int
+		CurPage  int
+		CanWatch bool
+		Watching bool
 	}{
 		Forum:   *common.Kforum,
 		Topic:   topic,
@@ -88,6 +96,10 @@ NEXT:
 	model.TopicID = topicID
 	_, model.PostToken = common.Kforum.UUID()
 	model.IsAdmin = isAdmin
+	if model.CanWatch = user.IsValid() && !topic.Archived; model.CanWatch {
+		model.Watching = common.Kforum.IsWatching(user.ID, topic.ID)
+		common.Kforum.MarkTopicSeen(user.ID, topic.ID)
+	}
 	server.Render(w, server.TmplTopic, model)
 }
 
@@ -105,7 +117,7 @@ func Topics(w http.ResponseWriter, r *http.Request) {
 		filter = common.TopicFilter2
 	}
 	topics := common.Kforum.GetTopics((p-1)*common.Kforum.TopicsPerPage, common.Kforum.TopicsPerPage,
-		filter,
+		func(t *server.Topic) bool { return filter(t) && t.IsVisibleTo(user.ID, isAdmin) },
 		func(topic *server.Topic) server.Topic {
 			t := *topic
 			t.T_TotalPosts = uint16(len(t.Posts) - 1)
@@ -123,6 +135,7 @@ func Topics(w http.ResponseWriter, r *http.Request) {
 			}
 			t.Posts[0].T_SetStatus(server.POST_T_ISFIRST)
 			t.Reparent(user.ID)
+			t.HidePending(isAdmin)
 			return t
 		})
 
@@ -180,6 +193,10 @@ NEXT:
 	topic.Posts[0].T_SetStatus(server.POST_T_ISREF)
 	topic.Reparent(user.ID)
 	topic.Posts[0].T_UnsetStatus(server.POST_T_ISOP)
+	if topic.HidePending(user.CanModerate()); len(topic.Posts) == 0 {
+		w.WriteHeader(404)
+		return
+	}
 
 	if raw == "raw" {
 		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+// actions which are disclosed to the public, and how they are presented
+var publicModActions = map[string]string{
+	"delete":       "删除回复",
+	"delete-image": "删除附图",
+	"lock":         "锁定主题",
+	"purge":        "永久删除主题",
+	"block":        "封禁",
+}
+
+type publicModAction struct {
+	server.ModAction
+	Mod  string
+	Name string
+	Link string
+}
+
+// modLabel gives every moderator a stable label which can't be traced back to the ID
+func modLabel(actor [8]byte) string {
+	h := sha1.New()
+	h.Write(common.Kforum.Salt[:])
+	h.Write(actor[:])
+	return fmt.Sprintf("版主 #%X", h.Sum(nil)[:2])
+}
+
+// publicBanTerm returns the banned user ID, or "IP" if the term isn't a user ID, IP addresses are never disclosed
+func publicBanTerm(target string) string {
+	// old records may carry the duration as "term,hours"
+	if idx := strings.Index(target, ","); idx > -1 {
+		target = target[:idx]
+	}
+	if strings.Contains(target, "/") {
+		return "IP"
+	}
+	// anything which isn't the canonical form of a user ID is considered an IP address
+	if _, id := server.Format8Bytes(server.Parse8Bytes(target)); id == "" || id != target {
+		return "IP"
+	}
+	return target
+}
+
+func getPublicModActions(n int) []publicModAction {
+	actions, _ := common.Kforum.GetModActions(0, n, func(a *server.ModAction) bool {
+		_, ok := publicModActions[a.Action]
+		return ok
+	})
+
+	res := make([]publicModAction, len(actions))
+	for i, a := range actions {
+		res[i] = publicModAction{ModAction: a, Mod: modLabel(a.Actor), Name: publicModActions[a.Action]}
+		switch a.Action {
+		case "delete", "delete-image":
+			res[i].Link = "/p/" + a.Target
+		case "lock", "purge":
+			res[i].Link = "/t/" + a.Target
+		case "block":
+			res[i].Target = publicBanTerm(a.Target)
+		}
+	}
+	return res
+}
+
+// url: /transparency
+func Transparency(w http.ResponseWriter, r *http.Request) {
+	model := struct {
+		server.Forum
+		Actions []publicModAction
+	}{
+		Forum:   *common.Kforum,
+		Actions: getPublicModActions(200),
+	}
+	server.Render(w, server.TmplTransparency, model)
+}
+
+// url: /transparency.xml
+func TransparencyRSS(w http.ResponseWriter, r *http.Request) {
+	xml := []string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`<rss version="2.0"><channel>`,
+		`<title>`, common.Kforum.Title, ` - 管理公示</title>`,
+		`<pubDate>`, time.Now().Format(time.RFC1123Z), `</pubDate>`,
+		`<link>`, common.Kforum.URL, `/transparency</link>`,
+	}
+
+	for _, a := range getPublicModActions(50) {
+		desc := a.Mod
+		if a.Reason != "" {
+			desc += ": " + html.EscapeString(a.Reason)
+		}
+
+		xml = append(xml,
+			`<item>`,
+			`<title>`, a.Name, ` `, html.EscapeString(a.Target), `</title>`,
+			`<pubDate>`, time.Unix(int64(a.CreatedAt), 0).Format(time.RFC1123Z), `</pubDate>`,
+			`<link>`, common.Kforum.URL, "/transparency", `</link>`,
+			`<guid isPermaLink="false">`, html.EscapeString(fmt.Sprintf("%d-%s-%s", a.CreatedAt, a.Action, a.Target)), `</guid>`,
+			`<description>`, `<![CDATA[`, desc, `]]>`, `</description>`,
+			`</item>`,
+		)
+	}
+
+	xml = append(xml, "</channel></rss>")
+
+	w.Header().Add("Content-Type", "application/xml")
+	w.Write([]byte(strings.Join(xml, "")))
+}
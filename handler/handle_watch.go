@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+// url: /watched
+func Watched(w http.ResponseWriter, r *http.Request) {
+	u := common.Kforum.GetUser(r)
+	model := struct {
+		server.Forum
+		IsValid bool
+		Topics  []server.WatchedTopic
+	}{Forum: *common.Kforum, IsValid: u.IsValid()}
+
+	if model.IsValid {
+		model.Topics = common.Kforum.GetWatchedTopics(u.ID)
+	}
+	server.Render(w, server.TmplWatched, model)
+}
+
+// url: /api/watch
+func WatchAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.Referer(), common.Kforum.URL) && common.Kprod {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u := common.Kforum.GetUser(r)
+	if !u.IsValid() {
+		writeSimpleJSON(w, "success", false, "error", "bad-request")
+		return
+	}
+
+	topicID, _ := strconv.Atoi(r.FormValue("topic"))
+	if err := common.Kforum.WatchTopic(u.ID, uint32(topicID), r.FormValue("watch") == "1"); err != nil {
+		writeSimpleJSON(w, "success", false, "error", "operation-failed", "message", err.Error())
+		return
+	}
+	writeSimpleJSON(w, "success", true)
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -108,10 +109,16 @@ func Help(w http.ResponseWriter, r *http.Request) {
 	fi, _ := os.Stat(path)
 	p := struct {
 		server.Forum
-		DataBinSize uint64
-		DataBinTime string
+		DataBinSize  uint64
+		DataBinTime  string
+		RecoveryCode string
+		Member       server.Member
 	}{}
 	p.Forum = *common.Kforum
+	if u := common.Kforum.GetUser(r); u.IsValid() {
+		p.RecoveryCode = common.Kforum.EncodeRecoveryCode(u)
+		p.Member = common.Kforum.GetMember(u.ID)
+	}
 	if fi != nil {
 		p.DataBinSize = uint64(fi.Size())
 		p.DataBinTime = fi.ModTime().Format(time.RFC1123)
@@ -124,31 +131,58 @@ func RobotsTxt(w http.ResponseWriter, r *http.Request) {
 	serveFileFromDir(w, r, "static", "robots.txt")
 }
 
+// makeUser parses "ID,MASK,N,ROLE" into a new user,
+// privileged ones are recorded as sessions so they can be revoked later
+func makeUser(makeid string, issuer [8]byte) server.User {
+	u, parts := server.User{T: time.Now().Unix()}, strings.Split(makeid, ",")
+	u.CreatedAt = u.T
+	copy(u.ID[:], parts[0])
+	if len(parts) > 1 {
+		u.M, _, _, _, _, _, _, _, _, _ = atoi(parts[1])
+	}
+	if len(parts) > 2 {
+		_, _, _, _, u.N, _, _, _, _, _ = atoi(parts[2])
+	}
+	if len(parts) > 3 {
+		u.R, _, _, _, _, _, _, _, _, _ = atoi(parts[3])
+	}
+
+	if u.M&^server.PERM_NO_ROLL != 0 || u.R != 0 {
+		if err := common.Kforum.AddSession(server.Session{ID: u.ID, T: u.T, M: u.M, R: u.R, Issuer: issuer}); err != nil {
+			common.Kforum.Error("session: %v", err)
+		}
+	}
+	return u
+}
+
 func Cookie(w http.ResponseWriter, r *http.Request) {
-	if m := r.FormValue("admin"); m == common.Kpassword {
+	if m := r.FormValue("admin"); m != "" {
 		// admin requesting a cookie
-		u, parts := server.User{}, strings.Split(r.FormValue("makeid"), ",")
-		copy(u.ID[:], parts[0])
-		u.M, _, _, _, _, _, _, _, _, _ = atoi(parts[1])
-		if len(parts) > 2 {
-			_, _, _, _, u.N, _, _, _, _, _ = atoi(parts[2])
+		ipAddr := getIPAddress(r)
+		if !throtNewPost(ipAddr, [8]byte{}) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
 		}
+		if common.Kadmin == nil || !common.Kadmin.Verify(m, r.FormValue("otp")) {
+			ipstr, _ := server.Format8Bytes(ipAddr)
+			common.Kforum.Notice("failed admin login from %s", ipstr)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		u := makeUser(r.FormValue("makeid"), [8]byte{})
 		common.Kforum.SetUser(w, u)
 		http.Redirect(w, r, "/", 302)
 		return
 	}
 	if m := r.FormValue("makeid"); m != "" {
-		if !common.Kforum.GetUser(r).Can(server.PERM_ADMIN) {
+		admin := common.Kforum.GetUser(r)
+		if !admin.Can(server.CAP_ADMIN) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		u, parts := server.User{}, strings.Split(m, ",")
-		copy(u.ID[:], parts[0])
-		u.M, _, _, _, _, _, _, _, _, _ = atoi(parts[1])
-		if len(parts) > 2 {
-			_, _, _, _, u.N, _, _, _, _, _ = atoi(parts[2])
-		}
+		u := makeUser(m, admin.ID)
 		w.Write([]byte(common.Kforum.SetUser(nil, u)))
 		return
 	}
@@ -164,7 +198,7 @@ func Cookie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Write([]byte("<html><title>Boon</title><form><input name='admin'/> <input name='makeid'/> <input type='submit'/></form></html>"))
+	w.Write([]byte("<html><title>Boon</title><form method='post'><input name='admin' type='password'/> <input name='otp' placeholder='TOTP'/> <input name='makeid'/> <input type='submit'/></form></html>"))
 
 	uid, _ := r.Cookie("uid")
 	if uid != nil {
@@ -172,8 +206,73 @@ func Cookie(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// url: /api/identity
+func Identity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.Referer(), common.Kforum.URL) && common.Kprod {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// one attempt per cooldown to stop guessing
+	ipAddr := getIPAddress(r)
+	if !throtNewPost(ipAddr, [8]byte{}) {
+		writeSimpleJSON(w, "success", false, "error", "bad-request")
+		return
+	}
+
+	u, ok := common.Kforum.DecodeRecoveryCode(r.FormValue("code"))
+	if !ok || common.Kforum.IsRevoked(u.ID, u.T) {
+		ipstr, _ := server.Format8Bytes(ipAddr)
+		common.Kforum.Notice("invalid recovery code from %s", ipstr)
+		writeSimpleJSON(w, "success", false, "error", "invalid-code")
+		return
+	}
+
+	common.Kforum.SetUser(w, u)
+	writeSimpleJSON(w, "success", true)
+}
+
+// url: /api/invite
+func Invite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.Referer(), common.Kforum.URL) && common.Kprod {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ipAddr := getIPAddress(r)
+	if common.Kforum.GetUser(r).IsValid() || !throtNewPost(ipAddr, [8]byte{}) {
+		writeSimpleJSON(w, "success", false, "error", "bad-request")
+		return
+	}
+
+	u := server.User{T: time.Now().Unix(), N: uint32(common.Kforum.Rand.Intn(10) + 10)}
+	u.CreatedAt = u.T
+	copy(u.ID[2:], common.Kforum.Rand.Fetch(6))
+
+	if err := common.Kforum.RedeemInvite(r.FormValue("code"), u.ID); err != nil {
+		ipstr, _ := server.Format8Bytes(ipAddr)
+		common.Kforum.Notice("invalid invite code from %s", ipstr)
+		writeSimpleJSON(w, "success", false, "error", "invalid-code")
+		return
+	}
+
+	common.Kforum.SetUser(w, u)
+	writeSimpleJSON(w, "success", true)
+}
+
 func Mod(w http.ResponseWriter, r *http.Request) {
-	if !common.Kforum.GetUser(r).Can(server.PERM_ADMIN) {
+	u := common.Kforum.GetUser(r)
+	if !u.CanModerate() {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -183,11 +282,25 @@ func Mod(w http.ResponseWriter, r *http.Request) {
 
 	model := struct {
 		server.Forum
-		Errors  []*server.TimestampedMsg
-		Notices []*server.TimestampedMsg
-		Header  *http.Header
-		IP      string
-		IQLen   int
+		Errors    []*server.TimestampedMsg
+		Notices   []*server.TimestampedMsg
+		Header    *http.Header
+		IP        string
+		IQLen     int
+		Ranges    []server.Ban
+		Pending   []server.Post
+		Reports   []server.ReportedPost
+		IsAdmin   bool
+		Caps      []string
+		Sessions  []server.Session
+		Invites   []server.Invite
+		CanInvite bool
+		Names     []server.Member
+		Tokens    []server.APIToken
+		Webhooks  []server.Webhook
+		Events    []string
+		WHQueue   int
+		Delivered []*server.TimestampedMsg
 		runtime.MemStats
 	}{
 		Forum:    *common.Kforum,
@@ -196,7 +309,71 @@ func Mod(w http.ResponseWriter, r *http.Request) {
 		Notices:  common.Kforum.GetNotices(),
 		Header:   &r.Header,
 		IQLen:    common.Kiq.Len(),
+		Ranges:   common.Kforum.GetBannedRanges(),
+	}
+	model.Pending = common.Kforum.GetPendingPosts(50)
+	model.Reports = common.Kforum.GetReportedPosts()
+	model.IsAdmin = u.Can(server.CAP_ADMIN)
+	model.Caps = server.Capabilities
+	if model.IsAdmin {
+		model.Sessions = common.Kforum.GetSessions()
+		model.Tokens = common.Kforum.GetTokens()
+		model.Webhooks = common.Kwebhooks.Hooks()
+		model.Events = server.WebhookEvents
+		model.WHQueue = common.Kwebhooks.Len()
+		model.Delivered = common.Kwebhooks.GetDeliveries()
+	}
+	if u.Can(server.CAP_APPROVE) {
+		model.Names = common.Kforum.GetMembers(true)
+	}
+	if model.CanInvite = u.Can(server.CAP_INVITE); model.CanInvite {
+		model.Invites = common.Kforum.GetInvites()
 	}
 	model.IP, _ = server.Format8Bytes(getIPAddress(r))
 	server.Render(w, server.TmplLogs, model)
 }
+
+// url: /mod/log?by=ID&p=N
+func ModLog(w http.ResponseWriter, r *http.Request) {
+	if !common.Kforum.GetUser(r).Can(server.CAP_ADMIN) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	const perPage = 50
+	p, _ := strconv.Atoi(r.FormValue("p"))
+	if p < 1 {
+		p = 1
+	}
+
+	var filter func(*server.ModAction) bool
+	if q := r.FormValue("by"); q != "" {
+		by := server.Parse8Bytes(q)
+		filter = func(a *server.ModAction) bool { return a.Actor == by }
+	}
+
+	model := struct {
+		server.Forum
+		Actions  []server.ModAction
+		By       string
+		CurPage  int
+		PrevPage int
+		NextPage int
+		Pages    int
+	}{
+		Forum:   *common.Kforum,
+		By:      r.FormValue("by"),
+		CurPage: p,
+	}
+
+	var total int
+	model.Actions, total = common.Kforum.GetModActions((p-1)*perPage, perPage, filter)
+	model.Pages = intdivceil(total, perPage)
+	if p > 1 {
+		model.PrevPage = p - 1
+	}
+	if p < model.Pages {
+		model.NextPage = p + 1
+	}
+	server.Render(w, server.TmplModLog, model)
+}
@@ -1,55 +1,283 @@
 package handler
 
 import (
-	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coyove/fofou/common"
 	"github.com/coyove/fofou/server"
 )
 
-func modCode(forum *server.Forum, u server.User, subject, msg string) bool {
-	r := bufio.NewReader(strings.NewReader(msg))
-	opcode := false
+var (
+	errPermission = fmt.Errorf("permission denied")
+	errUnknownOp  = fmt.Errorf("unknown operation")
+)
+
+// modValueError is returned when the value of an operation can't be parsed
+type modValueError struct{ error }
+
+// maxReasonLen caps reasons in runes, they are shown on the /mod page and stored in the log
+const maxReasonLen = 256
+
+type modRequest struct {
+	Op      string `json:"op"`
+	Value   string `json:"value"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// url: /api/mod
+func ModAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.Referer(), common.Kforum.URL) && common.Kprod {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	writeError := func(code string, err error) {
+		if err != nil {
+			writeSimpleJSON(w, "success", false, "error", code, "message", err.Error())
+		} else {
+			writeSimpleJSON(w, "success", false, "error", code)
+		}
+	}
+
+	req := modRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1024*1024)).Decode(&req); err != nil {
+		writeError("bad-request", err)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if tmp := []rune(req.Reason); len(tmp) > maxReasonLen {
+		req.Reason = string(tmp[:maxReasonLen])
+	}
 
-	if u.Can(server.PERM_APPEND_ANNOUNCE) {
-		if strings.HasPrefix(subject, "!!append=") {
-			vint, _ := strconv.ParseInt(subject[9:], 10, 64)
-			common.Kforum.AppendPost(uint64(vint), "\n"+msg)
-			return true
+	ipAddr, u := getIPAddress(r), common.Kforum.GetUser(r)
+	if !u.CanModerate() {
+		// normal users can only operate on their own posts, or report others
+		if ban, ok := common.Kforum.Store.GetIPBan(ipAddr); ok {
+			writeBanned(w, ban)
+			return
 		}
-		if strings.HasPrefix(subject, "!!announce") {
-			common.Kforum.ForumConfig.Announcement = msg
-			opcode = true
-			goto UPDATE
+		if ban, ok := common.Kforum.Store.GetBan(u.ID); ok {
+			writeBanned(w, ban)
+			return
+		}
+		if !u.IsValid() || !throtNewPost(ipAddr, u.ID) {
+			writeError("bad-request", nil)
+			return
 		}
 	}
 
-	for {
-		line, _, err := r.ReadLine()
-		if err != nil {
+	var err error
+	switch req.Op {
+	case "report-post":
+		vint, _ := strconv.ParseInt(req.Value, 10, 64)
+		err = common.Kforum.ReportPost(uint64(vint), u.ID, req.Reason)
+	case "append":
+		if !u.Can(server.CAP_APPEND) {
+			err = errPermission
 			break
 		}
-
-		msg := string(line)
-		if !strings.HasPrefix(msg, "!!") {
+		vint, _ := strconv.ParseInt(req.Value, 10, 64)
+		if err = common.Kforum.AppendPost(uint64(vint), "\n"+req.Message); err == nil {
+			logModAction(u, "append", req.Value, req.Reason)
+		}
+	case "announce":
+		if !u.Can(server.CAP_ANNOUNCE) {
+			err = errPermission
 			break
 		}
+		common.Kforum.ForumConfig.Announcement = req.Message
+		if err = common.Kforum.UpdateConfig(common.Kforum.ForumConfig); err == nil {
+			logModAction(u, "config", "announce", req.Reason)
+		}
+	case "webhooks":
+		// secrets are kept out of the audit log
+		hooks := []server.Webhook{}
+		if !u.Can(server.CAP_ADMIN) {
+			err = errPermission
+		} else if err = json.Unmarshal([]byte(req.Value), &hooks); err != nil {
+			err = &modValueError{err}
+		} else if err = common.Kwebhooks.SetHooks(hooks); err != nil {
+			err = &modValueError{err}
+		} else {
+			logModAction(u, "config", fmt.Sprintf("webhooks=%d", len(hooks)), req.Reason)
+		}
+	case "token":
+		var token string
+		if token, err = CreateToken(u, req.Value, req.Reason); err == nil {
+			writeSimpleJSON(w, "success", true, "token", token)
+			return
+		}
+	case "invite":
+		// the code is only shown once, the log only keeps its hash
+		var code string
+		if code, err = CreateInvite(u, req.Value, req.Reason); err == nil {
+			writeSimpleJSON(w, "success", true, "code", code)
+			return
+		}
+	default:
+		err = Moderate(u, req.Op, req.Value, req.Reason)
+	}
 
-		eidx := strings.Index(msg, "=")
-		if eidx == -1 {
-			break
+	switch err {
+	case nil:
+	case errPermission:
+		writeError("permission-denied", nil)
+		return
+	case errUnknownOp:
+		writeError("unknown-op", nil)
+		return
+	default:
+		if _, ok := err.(*modValueError); ok {
+			writeError("invalid-value", err)
+		} else {
+			writeError("operation-failed", err)
 		}
+		return
+	}
 
-		v := msg[eidx+1:]
-		vint, _ := strconv.ParseInt(v, 10, 64)
-		switch op := msg[2:eidx]; op {
-		case "moat":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
-			}
+	_, username := server.Format8Bytes(u.ID)
+	ipstr, _ := server.Format8Bytes(ipAddr)
+	common.Kforum.Notice("mod %s from %s has performed: %s=%s", username, ipstr, req.Op, req.Value)
+	writeSimpleJSON(w, "success", true)
+}
+
+// Moderate performs the operation on behalf of u, saves the config if needed and records it into the audit log
+func Moderate(u server.User, op, value, reason string) error {
+	config, err := modAction(u, op, value, reason)
+	if err != nil {
+		return err
+	}
+
+	if config {
+		if err := common.Kforum.UpdateConfig(common.Kforum.ForumConfig); err != nil {
+			return err
+		}
+		logModAction(u, "config", op+"="+value, reason)
+	} else {
+		if idx := strings.Index(value, ","); op == "block" && idx > -1 {
+			// the duration is a part of the ban, not the target
+			value = value[:idx]
+		}
+		logModAction(u, op, value, reason)
+	}
+	return nil
+}
+
+// CreateInvite mints an invite code which can be used maxUses times
+func CreateInvite(u server.User, maxUses, reason string) (string, error) {
+	if !u.Can(server.CAP_INVITE) {
+		return "", errPermission
+	}
+
+	n, _ := strconv.Atoi(maxUses)
+	if n <= 0 || n > 1000 {
+		return "", &modValueError{fmt.Errorf("max uses should be within 1 ~ 1000")}
+	}
+
+	code, id := server.NewInviteCode()
+	if err := common.Kforum.AddInvite(server.Invite{
+		ID:        id,
+		Creator:   u.ID,
+		CreatedAt: uint32(time.Now().Unix()),
+		MaxUses:   uint16(n),
+	}); err != nil {
+		return "", err
+	}
+
+	logModAction(u, "invite", fmt.Sprintf("%x", id), reason)
+	return code, nil
+}
+
+// CreateToken issues an API token, v is "name,posts per hour,scope,scope...", e.g.: "newsbot,60,topic,reply",
+// posts are made by the ID of the name, which should be 1 ~ 8 letters
+func CreateToken(u server.User, v, reason string) (string, error) {
+	if !u.Can(server.CAP_ADMIN) {
+		return "", errPermission
+	}
+
+	parts := strings.SplitN(v, ",", 3)
+	if len(parts) != 3 {
+		return "", &modValueError{fmt.Errorf("format: name,posts per hour,scopes")}
+	}
+
+	name := strings.TrimSpace(parts[0])
+	if len(name) == 0 || len(name) > 8 || strings.Trim(name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", &modValueError{fmt.Errorf("name should be 1 ~ 8 letters")}
+	}
+
+	limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || limit < 0 || limit > 3600 {
+		return "", &modValueError{fmt.Errorf("posts per hour should be within 0 ~ 3600")}
+	}
+
+	scopes, err := server.ParseTokenScopes(parts[2])
+	if err != nil {
+		return "", &modValueError{err}
+	}
+
+	token, id := server.NewAPIToken()
+	t := server.APIToken{
+		ID:        id,
+		Creator:   u.ID,
+		CreatedAt: uint32(time.Now().Unix()),
+		Scopes:    scopes,
+		RateLimit: uint16(limit),
+	}
+	copy(t.User[:], name)
+	if err := common.Kforum.AddToken(t); err != nil {
+		return "", err
+	}
+
+	logModAction(u, "token", fmt.Sprintf("%x,%s,%d,%s", id, name, limit, t.ScopeNames()), reason)
+	return token, nil
+}
+
+// logModAction records the operation into the audit log if it is performed by a moderator
+func logModAction(u server.User, action, target, reason string) {
+	if !u.CanModerate() {
+		return
+	}
+	a := server.ModAction{
+		CreatedAt: uint32(time.Now().Unix()),
+		Actor:     u.ID,
+		Action:    action,
+		Target:    target,
+		Reason:    reason,
+	}
+	if err := common.Kforum.LogModAction(a); err != nil {
+		common.Kforum.Error("audit log: %v", err)
+	}
+	fireWebhook(server.EventMod, webhookModAction{Actor: a.ActorName(), Action: action, Target: target, Reason: reason})
+}
+
+// modAction performs a single moderation command, returns true if the forum config has been changed
+func modAction(u server.User, op, v, reason string) (bool, error) {
+	vint, _ := strconv.ParseInt(v, 10, 64)
+	admin := func(f func()) (bool, error) {
+		if !u.Can(server.CAP_ADMIN) {
+			return false, errPermission
+		}
+		f()
+		return true, nil
+	}
+
+	switch op {
+	case "moat":
+		return admin(func() {
 			switch v {
 			case "cookie":
 				common.Kforum.NoMoreNewUsers = !common.Kforum.NoMoreNewUsers
@@ -57,143 +285,198 @@ func modCode(forum *server.Forum, u server.User, subject, msg string) bool {
 				common.Kforum.NoImageUpload = !common.Kforum.NoImageUpload
 			case "recaptcha":
 				common.Kforum.NoRecaptcha = !common.Kforum.NoRecaptcha
+			case "legacy-cookie":
+				common.Kforum.NoOldCookies = !common.Kforum.NoOldCookies
 			case "production":
 				common.Kprod = !common.Kprod
 				common.Kforum.Logger.UseStdout = !common.Kprod
 			}
-			opcode = true
-		case "max-message-len":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
-			}
-			common.Kforum.MaxMessageLen = int(vint)
-			opcode = true
-		case "max-subject-len":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
-			}
-			common.Kforum.MaxSubjectLen = int(vint)
-			opcode = true
-		case "search-timeout":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
-			}
-			common.Kforum.SearchTimeout = int(vint)
-			opcode = true
-		case "cooldown":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
-			}
-			common.Kforum.Cooldown = int(vint)
-			opcode = true
-		case "max-image-size":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
-			}
-			common.Kforum.MaxImageSize = int(vint)
-			opcode = true
-		case "nsfw":
-			res := common.Kforum.Store.FlagPost(u, uint64(vint), server.OP_NSFW, func(p *server.Post) {
-				p.T_InvertStatus(server.POST_T_ISNSFW)
-			})
-			opcode = true
-			if res != nil {
-				common.Kforum.Error("%v", res)
-				break
-			}
-		case "delete", "delete-image":
-			res := common.Kforum.Store.DeletePost(u, uint64(vint), op == "delete-image", func(img *server.Image) {
-				if img != nil {
-					os.Remove(common.DATA_IMAGES + img.Path)
-					os.Remove(common.DATA_IMAGES + img.Path + ".thumb.jpg")
-				}
-			})
-			opcode = true
-			if res != nil {
-				common.Kforum.Error("%v", res)
-				break
-			}
-		case "stick":
-			if !u.Can(server.PERM_STICKY_PURGE) {
-				return true
-			}
-			res := common.Kforum.Store.OperateTopic(uint32(vint), server.OP_STICKY)
-			opcode = true
-			if res != nil {
-				common.Kforum.Error("%v", res)
-				break
-			}
-		case "lock":
-			if !u.Can(server.PERM_LOCK_SAGE_DELETE_FLAG) {
-				return true
-			}
-			res := common.Kforum.Store.OperateTopic(uint32(vint), server.OP_LOCK)
-			opcode = true
-			if res != nil {
-				common.Kforum.Error("%v", res)
-				break
-			}
-		case "purge":
-			if !u.Can(server.PERM_STICKY_PURGE) {
-				return true
-			}
-			res := common.Kforum.Store.OperateTopic(uint32(vint), server.OP_PURGE)
-			opcode = true
-			if res != nil {
-				common.Kforum.Error("%v", res)
-				break
-			}
-		case "free-reply":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
-			}
-			res := common.Kforum.Store.OperateTopic(uint32(vint), server.OP_FREEREPLY)
-			opcode = true
-			if res != nil {
-				common.Kforum.Error("%v", res)
-				break
+		})
+	case "max-message-len":
+		return admin(func() { common.Kforum.MaxMessageLen = int(vint) })
+	case "max-subject-len":
+		return admin(func() { common.Kforum.MaxSubjectLen = int(vint) })
+	case "search-timeout":
+		return admin(func() { common.Kforum.SearchTimeout = int(vint) })
+	case "cooldown":
+		return admin(func() { common.Kforum.Cooldown = int(vint) })
+	case "premod-hours":
+		return admin(func() { common.Kforum.PremodHours = int(vint) })
+	case "premod-posts":
+		return admin(func() { common.Kforum.PremodPosts = int(vint) })
+	case "max-image-size":
+		return admin(func() { common.Kforum.MaxImageSize = int(vint) })
+	case "title":
+		return admin(func() { common.Kforum.Title = v })
+	case "url":
+		return admin(func() { common.Kforum.URL = v })
+	case "ipv6-prefix":
+		return admin(func() {
+			common.Kforum.IPv6Prefix = int(vint)
+			common.Kforum.CorrectValues()
+		})
+	case "filter":
+		if !u.Can(server.CAP_ADMIN) {
+			return false, errPermission
+		}
+		config := server.FilterConfig{}
+		if err := json.Unmarshal([]byte(v), &config); err != nil {
+			return false, &modValueError{err}
+		}
+		rules, err := buildFilters(&config)
+		if err != nil {
+			return false, &modValueError{err}
+		}
+		setFilters(config, rules)
+		return true, nil
+	case "roles":
+		if !u.Can(server.CAP_ADMIN) {
+			return false, errPermission
+		}
+		roles := []server.Role{}
+		if err := json.Unmarshal([]byte(v), &roles); err != nil {
+			return false, &modValueError{err}
+		}
+		ids := map[byte]bool{}
+		for _, role := range roles {
+			if err := role.Validate(); err != nil {
+				return false, &modValueError{err}
 			}
-		case "sage":
-			opcode = true
-			res := common.Kforum.Store.SageTopic(uint32(vint), u)
-			if res != nil {
-				common.Kforum.Error("sage %v", res)
-				break
+			if ids[role.ID] {
+				return false, &modValueError{fmt.Errorf("duplicated role ID: %d", role.ID)}
 			}
-		case "block":
-			if !u.Can(server.PERM_BLOCK) {
-				return true
+			ids[role.ID] = true
+		}
+		common.Kforum.Roles = roles
+		return true, nil
+	case "max-live-topics":
+		if !u.Can(server.CAP_ADMIN) {
+			return false, errPermission
+		}
+		return false, common.Kforum.SetMaxLiveTopics(int(vint))
+	case "nsfw":
+		return false, common.Kforum.Store.FlagPost(u, uint64(vint), server.OP_NSFW, func(p *server.Post) {
+			p.T_InvertStatus(server.POST_T_ISNSFW)
+		})
+	case "delete", "delete-image":
+		if err := common.Kforum.Store.DeletePost(u, uint64(vint), op == "delete-image", func(img *server.Image) {
+			if img != nil {
+				os.Remove(common.DATA_IMAGES + img.Path)
+				os.Remove(common.DATA_IMAGES + img.Path + ".thumb.jpg")
 			}
-			common.Kforum.Store.Block(server.Parse8Bytes(v))
-			opcode = true
-		case "title":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
+		}); err != nil {
+			return false, err
+		}
+		topicID, _ := server.SplitID(uint64(vint))
+		fireWebhook(server.EventDelete, webhookPost{
+			LongID:    uint64(vint),
+			Topic:     topicID,
+			URL:       fmt.Sprintf("%s/p/%d", common.Kforum.URL, vint),
+			ImageOnly: op == "delete-image",
+		})
+		return false, nil
+	case "stick":
+		if !u.Can(server.CAP_STICKY) {
+			return false, errPermission
+		}
+		return false, common.Kforum.Store.OperateTopic(uint32(vint), server.OP_STICKY)
+	case "lock":
+		if !u.Can(server.CAP_LOCK) {
+			return false, errPermission
+		}
+		return false, common.Kforum.Store.OperateTopic(uint32(vint), server.OP_LOCK)
+	case "purge":
+		if !u.Can(server.CAP_PURGE) {
+			return false, errPermission
+		}
+		return false, common.Kforum.Store.OperateTopic(uint32(vint), server.OP_PURGE)
+	case "free-reply":
+		if !u.Can(server.CAP_ADMIN) {
+			return false, errPermission
+		}
+		return false, common.Kforum.Store.OperateTopic(uint32(vint), server.OP_FREEREPLY)
+	case "sage":
+		return false, common.Kforum.Store.SageTopic(uint32(vint), u)
+	case "block":
+		// {"op":"block","value":"term"} bans forever, {"op":"block","value":"term,hours"} bans for hours,
+		// term can be an ID, an IP or an IP range like 1.2.3.0/24
+		if !u.Can(server.CAP_BLOCK) {
+			return false, errPermission
+		}
+		var until uint32
+		if idx := strings.Index(v, ","); idx > -1 {
+			_, _, _, _, hours, _, _, _, _, _ := atoi(v[idx+1:])
+			if hours > 0 {
+				until = uint32(time.Now().Unix()) + hours*3600
 			}
-			common.Kforum.Title = v
-			opcode = true
-		case "max-live-topics":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
+			v = v[:idx]
+		}
+		if strings.Contains(v, "/") {
+			term, bits, err := server.ParseIPRange(v)
+			if err != nil {
+				return false, &modValueError{err}
 			}
-			common.Kforum.SetMaxLiveTopics(int(vint))
-			opcode = true
-		case "url":
-			if !u.Can(server.PERM_ADMIN) {
-				return true
+			return false, common.Kforum.Store.BanRange(term, bits, u.ID, until, reason)
+		}
+		return false, common.Kforum.Store.Ban(server.Parse8Bytes(v), u.ID, until, reason)
+	case "unblock":
+		if !u.Can(server.CAP_BLOCK) {
+			return false, errPermission
+		}
+		if strings.Contains(v, "/") {
+			term, bits, err := server.ParseIPRange(v)
+			if err != nil {
+				return false, &modValueError{err}
 			}
-			common.Kforum.URL = v
-			opcode = true
+			return false, common.Kforum.Store.UnbanRange(term, bits)
 		}
-	}
-
-UPDATE:
-	if opcode {
-		err := forum.UpdateConfig(common.Kforum.ForumConfig)
-		if err != nil {
-			forum.Logger.Error("update config: %v", err)
+		return false, common.Kforum.Store.Unban(server.Parse8Bytes(v))
+	case "revoke":
+		// revoke=ID,T revokes a single cookie, revoke=ID revokes all cookies of the ID issued so far
+		if !u.Can(server.CAP_ADMIN) {
+			return false, errPermission
+		}
+		var t int64
+		if idx := strings.Index(v, ","); idx > -1 {
+			t, _ = strconv.ParseInt(v[idx+1:], 10, 64)
+			v = v[:idx]
+		}
+		return false, common.Kforum.Store.Revoke(server.Parse8Bytes(v), t)
+	case "revoke-token":
+		if !u.Can(server.CAP_ADMIN) {
+			return false, errPermission
+		}
+		buf, err := hex.DecodeString(v)
+		if err != nil || len(buf) != 8 {
+			return false, &modValueError{fmt.Errorf("invalid token ID")}
 		}
+		var id [8]byte
+		copy(id[:], buf)
+		return false, common.Kforum.Store.RevokeToken(id)
+	case "approve-name", "reject-name", "remove-name":
+		if !u.Can(server.CAP_APPROVE) {
+			return false, errPermission
+		}
+		id := server.Parse8Bytes(v)
+		if op == "approve-name" {
+			return false, common.Kforum.Store.ApproveName(id, u.ID)
+		}
+		return false, common.Kforum.Store.DeleteName(id, op == "remove-name")
+	case "resolve":
+		if !u.Can(server.CAP_REPORTS) {
+			return false, errPermission
+		}
+		return false, common.Kforum.Store.ResolveReports(uint64(vint))
+	case "approve":
+		if !u.Can(server.CAP_APPROVE) {
+			return false, errPermission
+		}
+		if err := common.Kforum.Store.ApprovePost(uint64(vint)); err != nil {
+			return false, err
+		}
+		// approved posts become visible just now
+		firePostWebhook(uint64(vint))
+		return false, nil
 	}
-
-	return opcode
+	return false, errUnknownOp
 }
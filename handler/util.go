@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
 )
 
 var rxBot = regexp.MustCompile(`(bot|crawl|spider)`)
@@ -52,17 +53,7 @@ func getIPAddress(r *http.Request) (v [8]byte) {
 		ipAddr = hdrRealIP
 	}
 
-	ip := net.ParseIP(ipAddr)
-	if len(ip) == 0 {
-		return
-	}
-	ipv4 := ip.To4()
-	if len(ipv4) == 0 {
-		copy(v[:], ip)
-		return
-	}
-	copy(v[4:], ipv4[:3])
-	return
+	return server.EncodeIP(net.ParseIP(ipAddr), common.Kforum.IPv6Prefix)
 }
 
 func throtNewPost(ip, id [8]byte) bool {
@@ -104,6 +95,10 @@ func writeSimpleJSON(w http.ResponseWriter, args ...interface{}) {
 	w.Write(p.Bytes())
 }
 
+func writeBanned(w http.ResponseWriter, ban server.Ban) {
+	writeSimpleJSON(w, "success", false, "error", "banned", "reason", ban.Reason, "until", ban.Until)
+}
+
 func sanitizeFilename(name string) string {
 	const needle = "\\/:*?\"<>| "
 	if !strings.ContainsAny(name, needle) && len(name) <= 32 {
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/coyove/fofou/common"
+	"github.com/coyove/fofou/server"
+)
+
+// webhookPost is the data of topic, post and delete events
+type webhookPost struct {
+	LongID    uint64 `json:"longid"`
+	Topic     uint32 `json:"topic"`
+	Subject   string `json:"subject,omitempty"`
+	User      string `json:"user,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Image     string `json:"image,omitempty"`
+	CreatedAt uint32 `json:"created_at,omitempty"`
+	URL       string `json:"url"`
+	ImageOnly bool   `json:"image_only,omitempty"`
+}
+
+// webhookModAction is the data of mod events
+type webhookModAction struct {
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func fireWebhook(event string, data interface{}) {
+	common.Kwebhooks.Fire(event, common.Kforum.URL, data)
+}
+
+// firePostWebhook fires the topic or post event of a visible post
+func firePostWebhook(longID uint64) {
+	topicID, postID := server.SplitID(longID)
+	topic := common.Kforum.Store.GetTopic(topicID, server.DefaultTopicMapper)
+	if topic.ID == 0 || postID == 0 || int(postID) > len(topic.Posts) {
+		return
+	}
+
+	p := &topic.Posts[postID-1]
+	if p.IsDeleted() || p.IsPending() {
+		return
+	}
+
+	data := webhookPost{
+		LongID:    longID,
+		Topic:     topic.ID,
+		Subject:   topic.Subject,
+		User:      p.PublicName(),
+		Message:   p.Message,
+		CreatedAt: p.CreatedAt,
+		URL:       fmt.Sprintf("%s/p/%d", common.Kforum.URL, longID),
+	}
+	if p.Image != nil {
+		data.Image = fmt.Sprintf("%s/i/%s", common.Kforum.URL, p.Image.Path)
+	}
+
+	if postID == 1 {
+		fireWebhook(server.EventTopic, data)
+	} else {
+		fireWebhook(server.EventPost, data)
+	}
+}
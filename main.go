@@ -22,10 +22,11 @@ const testPassword = "passw0rd"
 
 var (
 	listen   = flag.String("addr", ":5010", "HTTP server address")
-	makeID   = flag.String("make", "", "Make ID, format: ID,MASK")
-	snapshot = flag.String("ss", "", "Make snapshot of main.txt")
+	makeID   = flag.String("make", "", "Make ID, format: ID,MASK[,ROLE]")
+	snapshot = flag.String("ss", "", "Make snapshot of main.txt and its private log")
 	csrf     = flag.String("csrf", "", "Change the URL for CSRF protection")
-	salt     = flag.String("s", testPassword, "A secret string used as both salt and admin password")
+	salt     = flag.String("s", testPassword, "A secret string used as the salt")
+	oldSalts = flag.String("old-salts", "", "Salts used before the current one, separated by commas, cookies signed by them are still accepted")
 )
 
 func newForum(logger *server.Logger) *server.Forum {
@@ -40,6 +41,11 @@ func newForum(logger *server.Logger) *server.Forum {
 			forum.ForumConfig.CorrectValues()
 			forum.ForumConfig.Invalidate = time.Now().Unix()
 			forum.SetSalt(*salt)
+			for _, s := range strings.Split(*oldSalts, ",") {
+				if s != "" {
+					forum.OldSalts = append(forum.OldSalts, server.MakeSalt(s))
+				}
+			}
 
 			rbuf, _ := ioutil.ReadFile(common.DATA_RECAPTCHA)
 			rparts := strings.Split(string(rbuf), "|")
@@ -52,6 +58,7 @@ func newForum(logger *server.Logger) *server.Forum {
 
 	common.KbadUsers = lru.NewCache(1024)
 	common.Kuuids = lru.NewCache(1024)
+	common.Kdups = lru.NewCache(1024)
 	common.Karchive = lru.NewCache(256)
 	common.KthrotIPID = lru.NewCache(256)
 
@@ -123,7 +130,6 @@ func main() {
 
 	flag.Parse()
 	logger := server.NewLogger(1024, 1024, true, common.DATA_LOGS+"f2")
-	common.Kpassword = *salt
 
 	if *salt == testPassword {
 		logger.Notice("you are using the test password/salt, fofou will run in test mode")
@@ -133,11 +139,25 @@ func main() {
 		common.Kprod = true
 	}
 
+	if cred, err := server.LoadAdminCredential(common.DATA_ADMIN); err == nil {
+		common.Kadmin = cred
+	} else if !common.Kprod {
+		// test mode, the test password will be the admin password
+		common.Kadmin = &server.AdminCredential{}
+		common.Kadmin.SetPassword(testPassword)
+	} else {
+		logger.Notice("admin login is disabled, run 'fofou passwd' to set the admin password: %v", err)
+	}
+
 	if *makeID != "" {
 		u, parts := server.User{}, strings.Split(*makeID, ",")
 		copy(u.ID[:], parts[0])
 		m, _ := strconv.Atoi(parts[1])
 		u.M = byte(m)
+		if len(parts) > 2 {
+			r, _ := strconv.Atoi(parts[2])
+			u.R = byte(r)
+		}
 
 		forum := &server.Forum{}
 		forum.ForumConfig = &server.ForumConfig{}
@@ -147,7 +167,12 @@ func main() {
 	}
 
 	common.Kforum = newForum(logger)
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	common.Kiq = server.NewImageQueue(logger, 200, runtime.NumCPU())
+	common.Kwebhooks = server.NewWebhookQueue(logger, common.DATA_WEBHOOKS, common.DATA_DELIVERY)
 
 	server.LoadTemplates(common.Kprod)
 
@@ -155,13 +180,33 @@ func main() {
 	smux.HandleFunc("/favicon.ico", http.NotFound)
 	smux.HandleFunc("/robots.txt", handler.RobotsTxt)
 	smux.HandleFunc("/mod", preHandle(handler.Mod, true))
+	smux.HandleFunc("/mod/log", preHandle(handler.ModLog, true))
 	smux.HandleFunc("/cookie", preHandle(handler.Cookie, false))
 	smux.HandleFunc("/s/", preHandle(handler.Static, false))
 	smux.HandleFunc("/status", preHandle(handler.Help, true))
 	smux.HandleFunc("/i/", preHandle(handler.Image, false))
 	smux.HandleFunc("/api", preHandle(handler.PostAPI, false))
+	smux.HandleFunc("/api/mod", preHandle(handler.ModAPI, false))
+	smux.HandleFunc("/api/identity", preHandle(handler.Identity, false))
+	smux.HandleFunc("/api/invite", preHandle(handler.Invite, false))
+	smux.HandleFunc("/api/name", preHandle(handler.NameAPI, false))
+	smux.HandleFunc("/members", preHandle(handler.Members, true))
+	smux.HandleFunc("/inbox", preHandle(handler.Inbox, true))
+	smux.HandleFunc("/api/inbox", preHandle(handler.InboxAPI, false))
+	smux.HandleFunc("/watched", preHandle(handler.Watched, true))
+	smux.HandleFunc("/api/watch", preHandle(handler.WatchAPI, false))
+	smux.HandleFunc("/api/v1/topics", preHandle(handler.APITopics, false))
+	smux.HandleFunc("/api/v1/topic/", preHandle(handler.APITopic, false))
+	smux.HandleFunc("/api/v1/post/", preHandle(handler.APIPost, false))
+	smux.HandleFunc("/api/v1/search", preHandle(handler.APISearch, false))
+	smux.HandleFunc("/api/v1/posts", preHandle(handler.BotAPI, false))
+	smux.HandleFunc("/api/v1/events", handler.Events)
 	smux.HandleFunc("/list", preHandle(handler.List, true))
-	smux.HandleFunc("/rss.xml", preHandle(handler.RSS, false))
+	smux.HandleFunc("/rss.xml", preHandle(handler.Feed, false))
+	smux.HandleFunc("/atom.xml", preHandle(handler.Feed, false))
+	smux.HandleFunc("/feed.json", preHandle(handler.Feed, false))
+	smux.HandleFunc("/transparency", preHandle(handler.Transparency, true))
+	smux.HandleFunc("/transparency.xml", preHandle(handler.TransparencyRSS, false))
 	smux.HandleFunc("/data.bin", preHandle(handler.Help, false))
 	smux.HandleFunc("/t/", preHandle(handler.Topic, true))
 	smux.HandleFunc("/p/", preHandle(handler.Post, false))
@@ -195,6 +240,9 @@ func main() {
 
 	go func() {
 		for range time.Tick(time.Minute) {
+			if err := common.Kforum.Store.FlushWatches(); err != nil {
+				logger.Error("failed to flush watches: %v", err)
+			}
 		}
 	}()
 
@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
 
 var rxPGP = regexp.MustCompile(`^[\s\r\n\t]*-----BEGIN PGP SIGNED MESSAGE-----`)
 
+var (
+	rxCode = regexp.MustCompile("```[\\s\\S]*?```")
+	rxRef  = regexp.MustCompile(`>>(\d+)`)
+)
+
 var test, debug bool
 
 func isDigit(r rune) bool {
@@ -25,6 +31,29 @@ func lastHR(buf *bytes.Buffer) bool {
 	return false
 }
 
+// References returns the long IDs quoted by ">>" outside code blocks, without duplicates
+func References(in string) []uint64 {
+	if !strings.Contains(in, ">>") || rxPGP.MatchString(in) {
+		return nil
+	}
+
+	var refs []uint64
+NEXT:
+	for _, m := range rxRef.FindAllStringSubmatch(rxCode.ReplaceAllString(in, ""), -1) {
+		id, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil || id == 0 {
+			continue
+		}
+		for _, r := range refs {
+			if r == id {
+				continue NEXT
+			}
+		}
+		refs = append(refs, id)
+	}
+	return refs
+}
+
 func Do(in string, allowHTML bool, maxLength int) string {
 	if test && strings.HasPrefix(in, "DBG") {
 		debug = true
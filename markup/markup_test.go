@@ -51,3 +51,13 @@ func TestDo(t *testing.T) {
 	assert("[<a>[a</a>]]", true, "[&lt;a&gt;[a&lt;/a&gt;]]")
 	assert("[a====b]", true, "[a<hr>b]")
 }
+
+func TestReferences(t *testing.T) {
+	refs := References(">>12 abc >>34\n```>>56```>>12 >>x >>0")
+	if len(refs) != 2 || refs[0] != 12 || refs[1] != 34 {
+		t.Fatal(refs)
+	}
+	if References("no refs") != nil {
+		t.FailNow()
+	}
+}
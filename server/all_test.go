@@ -1,7 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/coyove/common/rand"
 )
@@ -100,3 +114,635 @@ func TestLongID(t *testing.T) {
 		}
 	}
 }
+
+// newTestStore opens a store in a new temporary directory, which is removed by cleanup
+func newTestStore(t *testing.T) (store *Store, path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "fofou-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "main.txt")
+	return openTestStore(path), path, func() { os.RemoveAll(dir) }
+}
+
+// assertNotInMainLog fails if any of needles is found in the main log, which is published as /data.bin
+func assertNotInMainLog(t *testing.T, path string, needles ...[]byte) {
+	t.Helper()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range needles {
+		if bytes.Contains(buf, n) {
+			t.Fatalf("%q found in the main log", n)
+		}
+	}
+}
+
+func openTestStore(path string, key ...[16]byte) *Store {
+	store := NewStore(path, append(key, [16]byte{})[0], nil)
+	for !store.IsReady() || store.dataFile == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return store
+}
+
+func TestBan(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	a, b, c := [8]byte{1}, [8]byte{2}, [8]byte{3}
+	store.Ban(a, c, 0, "forever")
+	store.Ban(b, c, uint32(time.Now().Unix())-1, "expired")
+
+	store = openTestStore(path)
+	if ban, ok := store.GetBan(a); !ok || ban.Reason != "forever" || ban.Mod != c {
+		t.Fatal(ban, ok)
+	}
+	if store.IsBlocked(b) {
+		t.FailNow()
+	}
+	assertNotInMainLog(t, path, []byte("forever"))
+
+	store.Unban(a)
+	store = openTestStore(path)
+	if store.IsBlocked(a) {
+		t.FailNow()
+	}
+}
+
+func TestModLog(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	a, b := [8]byte{1}, [8]byte{2}
+	for i := 0; i < 5; i++ {
+		store.LogModAction(ModAction{CreatedAt: uint32(i), Actor: a, Action: "delete", Target: strconv.Itoa(i)})
+	}
+	store.LogModAction(ModAction{CreatedAt: 5, Actor: b, Action: "lock", Target: "1", Reason: "spam"})
+
+	store = openTestStore(path)
+	if res, total := store.GetModActions(0, 2, nil); total != 6 || len(res) != 2 || res[0].Reason != "spam" {
+		t.Fatal(res, total)
+	}
+	if res, total := store.GetModActions(3, 10, func(m *ModAction) bool { return m.Actor == a }); total != 5 || len(res) != 2 || res[1].Target != "0" {
+		t.Fatal(res, total)
+	}
+
+	// the audit log must not be published along with the main log
+	assertNotInMainLog(t, path, []byte("spam"))
+
+	// a torn record at the end is dropped
+	f, _ := os.OpenFile(path+".private", os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 1})
+	f.Close()
+	store = openTestStore(path)
+	store.LogModAction(ModAction{CreatedAt: 6, Actor: b, Action: "lock", Target: "2"})
+	store = openTestStore(path)
+	if res, total := store.GetModActions(0, 1, nil); total != 7 || res[0].Target != "2" {
+		t.Fatal(res, total)
+	}
+}
+
+func TestReport(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	a, b := [8]byte{1}, [8]byte{'r', 'e', 'p', 'o', 'r', 't', 'e', 'r'}
+	longID, _ := store.NewTopic("topic", "hello world", nil, nil, a, a, false, false)
+	store.ReportPost(longID, b, "spam")
+	if err := store.ReportPost(longID, b, "spam"); err == nil {
+		t.FailNow()
+	}
+
+	store = openTestStore(path)
+	if res := store.GetReportedPosts(); len(res) != 1 || res[0].Reports[0].Reporter != b {
+		t.Fatal(res)
+	}
+	assertNotInMainLog(t, path, b[:])
+
+	store.ResolveReports(longID)
+	store = openTestStore(path)
+	if res := store.GetReportedPosts(); len(res) != 0 {
+		t.Fatal(res)
+	}
+}
+
+func TestFilterConfig(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// old stores have filters in the public config
+	store.UpdateConfig(map[string]interface{}{"Title": "forum", "Filter": FilterConfig{Words: []string{"old"}}})
+	c := &ForumConfig{}
+	if store.GetConfig(c); c.Title != "forum" || len(c.Filter.Words) != 1 || c.Filter.Words[0] != "old" {
+		t.Fatal(c)
+	}
+
+	c.Filter.Words = []string{"secretword"}
+	store.UpdateConfig(c)
+	store = openTestStore(path)
+	c = &ForumConfig{}
+	if store.GetConfig(c); c.Title != "forum" || len(c.Filter.Words) != 1 || c.Filter.Words[0] != "secretword" {
+		t.Fatal(c)
+	}
+	assertNotInMainLog(t, path, []byte("secretword"))
+}
+
+func TestUserCan(t *testing.T) {
+	u := User{M: PERM_LOCK_SAGE_DELETE_FLAG}
+	if !u.Can(CAP_DELETE) || u.Can(CAP_PURGE) || !u.CanModerate() {
+		t.Fatal(u)
+	}
+	if u := (User{M: PERM_NO_ROLL}); u.CanModerate() {
+		t.Fatal(u)
+	}
+	if u := (User{M: PERM_ADMIN}); !u.Can(CAP_BLOCK) {
+		t.Fatal(u)
+	}
+
+	f := &Forum{ForumConfig: &ForumConfig{Roles: []Role{{ID: 1, Name: "janitor", Caps: []string{CAP_DELETE}}}}}
+	f.SetSalt("test")
+
+	w := httptest.NewRecorder()
+	u = User{R: 1}
+	copy(u.ID[:], "tester")
+	f.SetUser(w, u)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+	if u = f.GetUser(r); !u.Can(CAP_DELETE) || u.Can(CAP_LOCK) {
+		t.Fatal(u)
+	}
+
+	f.Roles = nil
+	if u = f.GetUser(r); !u.IsValid() || u.Can(CAP_DELETE) {
+		t.Fatal(u)
+	}
+}
+
+func TestUserToken(t *testing.T) {
+	f := &Forum{ForumConfig: &ForumConfig{}}
+	f.SetSalt("test")
+
+	u := User{N: 10, Posts: 3, T: 1234567890, M: PERM_BLOCK, R: 2, CreatedAt: 1234567000}
+	copy(u.ID[:], "tester")
+
+	getUser := func(value string) User {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "uid", Value: value})
+		return f.GetUser(r)
+	}
+
+	tok := encodeUserToken(&u, f.Salt)
+	if u2 := getUser(tok); u2.ID != u.ID || u2.N != u.N || u2.Posts != u.Posts || u2.T != u.T || u2.M != u.M || u2.R != u.R || u2.CreatedAt != u.CreatedAt {
+		t.Fatal(u2)
+	}
+
+	// version 1 has no CreatedAt
+	buf, _ := base64.RawURLEncoding.DecodeString(tok)
+	v1 := append([]byte{1}, buf[1:userTokenV1Size]...)
+	if u2 := getUser(base64.RawURLEncoding.EncodeToString(append(v1, signUserToken(v1, f.Salt)...))); u2.ID != u.ID || u2.T != u.T || u2.CreatedAt != 0 {
+		t.Fatal(u2)
+	}
+	if u2 := getUser(tok[:len(tok)-2] + "AA"); u2.IsValid() {
+		t.Fatal(u2)
+	}
+
+	// legacy cookie
+	u.Hash = hashUser(&u, f.Salt)
+	buf, _ = json.Marshal(u)
+	legacy := strings.NewReplacer(",", "^", `"`, "'").Replace(string(buf))
+	if u2 := getUser(legacy); u2.ID != u.ID || u2.M != u.M {
+		t.Fatal(u2)
+	}
+
+	f.NoOldCookies = true
+	if u2 := getUser(legacy); u2.IsValid() {
+		t.Fatal(u2)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	id := [8]byte{0, 0, 'm', 'o', 'd'}
+	store.AddSession(Session{ID: id, T: 100, M: PERM_BLOCK})
+	store.AddSession(Session{ID: id, T: 200, M: PERM_BLOCK})
+	store.Revoke(id, 100)
+
+	store = openTestStore(path)
+	if s := store.GetSessions(); len(s) != 2 || s[0].Revoked || !s[1].Revoked {
+		t.Fatal(s)
+	}
+	assertNotInMainLog(t, path, id[:])
+
+	store.Revoke(id, 0)
+	if !store.IsRevoked(id, 200) || store.IsRevoked(id, time.Now().Unix()+1) {
+		t.Fatal(store.revoked)
+	}
+}
+
+func TestNeedsPremod(t *testing.T) {
+	now := time.Now().Unix()
+	c := &ForumConfig{PremodHours: 24, PremodPosts: 3}
+	if !c.NeedsPremod(User{Posts: 5, T: now, CreatedAt: now - 3600}) || !c.NeedsPremod(User{Posts: 1}) {
+		t.FailNow()
+	}
+	// IDs without CreatedAt are from before the upgrade, T is their last post then
+	if c.NeedsPremod(User{Posts: 5, T: now - 3600}) || c.NeedsPremod(User{Posts: 5, CreatedAt: now - 86400*2}) {
+		t.FailNow()
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	f := &Forum{ForumConfig: &ForumConfig{}}
+	f.SetSalt("test")
+
+	u := User{N: 12, Posts: 70000, T: 1234567890, M: PERM_ADMIN}
+	copy(u.ID[2:], "abcdef")
+
+	code := f.EncodeRecoveryCode(u)
+	if len(code) != 8*5+7 {
+		t.Fatal(code)
+	}
+	if u2, ok := f.DecodeRecoveryCode(strings.ToUpper(code)); !ok || u2.ID != u.ID || u2.N != u.N || u2.T != u.T || u2.CreatedAt != u.T || u2.Posts != 0xffff || u2.M != 0 {
+		t.Fatal(code, u2)
+	}
+
+	// version 1 has no Posts
+	v1 := make([]byte, recoveryCodeV1Size)
+	v1[0], v1[9] = 1, 12
+	copy(v1[1:], u.ID[:])
+	binary.BigEndian.PutUint32(v1[10:], uint32(u.T))
+	v1code := base32Encoding.EncodeToString(append(v1, signRecoveryCode(v1, f.Salt)[:recoveryCodeV1MACSize]...))
+	if u2, ok := f.DecodeRecoveryCode(v1code); !ok || u2.ID != u.ID || u2.T != u.T || u2.Posts != 0 {
+		t.Fatal(v1code, u2)
+	}
+
+	f.OldSalts = [][16]byte{f.Salt}
+	f.SetSalt("test2")
+	if _, ok := f.DecodeRecoveryCode(code); !ok {
+		t.Fatal(code)
+	}
+	if _, ok := f.DecodeRecoveryCode("a" + code[1:]); ok && code[0] != 'a' {
+		t.Fatal(code)
+	}
+}
+
+func TestInvite(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	code, id := NewInviteCode()
+	store.AddInvite(Invite{ID: id, MaxUses: 2})
+
+	if err := store.RedeemInvite(strings.ToUpper(code), [8]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RedeemInvite("wrong", [8]byte{2}); err == nil {
+		t.FailNow()
+	}
+
+	store = openTestStore(path)
+	if err := store.RedeemInvite(code, [8]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RedeemInvite(code, [8]byte{3}); err == nil {
+		t.FailNow()
+	}
+	if inv := store.GetInvites(); len(inv) != 1 || len(inv[0].Uses) != 2 || inv[0].Uses[1].User != [8]byte{2} {
+		t.Fatal(inv)
+	}
+	assertNotInMainLog(t, path, id[:])
+}
+
+func TestMemberName(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	a, b, mod := [8]byte{0, 0, 1}, [8]byte{0, 0, 2}, [8]byte{'m', 'o', 'd'}
+	if err := store.RequestName(a, "x"); err == nil {
+		t.FailNow()
+	}
+	store.RequestName(a, "alice")
+	if err := store.RequestName(b, "ALICE"); err == nil {
+		t.FailNow()
+	}
+	store.ApproveName(a, mod)
+	store.RequestName(a, "alice2")
+
+	store = openTestStore(path)
+	if m := store.GetMember(a); m.Name != "alice" || m.Requested != "alice2" || m.Approver != mod {
+		t.Fatal(m)
+	}
+	assertNotInMainLog(t, path, []byte("alice"), mod[:])
+	store.DeleteName(a, false)
+	if m := store.GetMembers(false); len(m) != 1 || m[0].Requested != "" || store.DisplayName(a) != "alice" {
+		t.Fatal(m)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	a, b, ip := [8]byte{0, 0, 1}, [8]byte{0, 0, 2}, [8]byte{}
+	op, _ := store.NewTopic("topic", "hello world", nil, nil, a, ip, false, false)
+	store.NewPost(1, fmt.Sprintf(">>%d self reply", op), nil, nil, a, ip, false, false)
+	reply, _ := store.NewPost(1, fmt.Sprintf(">>%d >>%d hi", op, op), nil, nil, b, ip, false, false)
+
+	if posts := store.GetInbox(a); len(posts) != 1 || posts[0].LongID() != reply {
+		t.Fatal(posts)
+	}
+
+	store = openTestStore(path)
+	if posts := store.GetInbox(a); len(posts) != 1 || len(store.GetInbox(b)) != 0 {
+		t.Fatal(posts)
+	}
+	if store.CountInbox(a, 0) != 1 || store.CountInbox(a, uint32(time.Now().Unix())) != 0 {
+		t.FailNow()
+	}
+
+	// held replies are neither listed nor counted
+	store.NewPost(1, fmt.Sprintf(">>%d held", op), nil, nil, b, ip, false, true)
+	if len(store.GetInbox(a)) != 1 || store.CountInbox(a, 0) != 1 {
+		t.FailNow()
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	a, ip := [8]byte{0, 0, 1}, [8]byte{}
+	store.NewTopic("topic", "hello world", nil, nil, a, ip, false, false)
+	if err := store.WatchTopic(a, 1, true); err != nil || !store.IsWatching(a, 1) {
+		t.Fatal(err)
+	}
+	store.NewPost(1, "reply 1", nil, nil, ip, ip, false, false)
+	store.NewPost(1, "reply 2", nil, nil, ip, ip, false, false)
+	store.NewPost(1, "held", nil, nil, ip, ip, false, true)
+
+	store = openTestStore(path)
+	if topics := store.GetWatchedTopics(a); len(topics) != 1 || topics[0].New != 2 {
+		t.Fatal(topics)
+	}
+	store.MarkTopicSeen(a, 1)
+	if topics := store.GetWatchedTopics(a); topics[0].New != 0 {
+		t.Fatal(topics)
+	}
+
+	// viewing a topic doesn't write anything until flushed
+	info, _ := os.Stat(path + ".private")
+	store.NewPost(1, "reply 3", nil, nil, ip, ip, false, false)
+	store.MarkTopicSeen(a, 1)
+	if info2, _ := os.Stat(path + ".private"); info2.Size() != info.Size() {
+		t.Fatal(info.Size(), info2.Size())
+	}
+	store.FlushWatches()
+	store = openTestStore(path)
+	if topics := store.GetWatchedTopics(a); topics[0].New != 0 {
+		t.Fatal(topics)
+	}
+	assertNotInMainLog(t, path, []byte{OP_WATCH, 0, 0, 1})
+
+	store.WatchTopic(a, 1, false)
+	store = openTestStore(path)
+	if store.IsWatching(a, 1) || len(store.GetWatchedTopics(a)) != 0 {
+		t.FailNow()
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fofou-test")
+	defer os.RemoveAll(dir)
+
+	fail, got := true, make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if fail {
+			w.WriteHeader(500)
+			got <- ""
+			return
+		}
+		if r.Header.Get("X-Fofou-Signature") != SignWebhook("secret", body) {
+			t.Error("bad signature")
+		}
+		got <- string(body)
+	}))
+	defer srv.Close()
+
+	l := &Logger{Errors: NewCircularMessagesBuf(16), Notices: NewCircularMessagesBuf(16)}
+	path, queue := filepath.Join(dir, "webhooks.txt"), filepath.Join(dir, "queue")
+	q := NewWebhookQueue(l, path, queue)
+	if q.SetHooks([]Webhook{{URL: "ftp://x"}}) == nil {
+		t.FailNow()
+	}
+	if err := q.SetHooks([]Webhook{{URL: srv.URL, Secret: "secret", Events: []string{EventPost}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Fire(EventMod, "", nil)
+	q.Fire(EventPost, "", map[string]int{"longid": 42})
+	<-got
+	for q.Len() != 1 || len(q.GetDeliveries()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the failed delivery is retried by the new queue after restarting
+	fail = false
+	q = NewWebhookQueue(l, path, queue)
+	select {
+	case body := <-got:
+		p := WebhookPayload{}
+		if json.Unmarshal([]byte(body), &p); p.Event != EventPost || p.Data.(map[string]interface{})["longid"] != 42.0 {
+			t.Fatal(body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	for q.Len() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files, _ := ioutil.ReadDir(queue); len(files) != 0 {
+		t.Fatal(files)
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if _, err := ParseTokenScopes("topic,delete"); err == nil {
+		t.FailNow()
+	}
+	scopes, _ := ParseTokenScopes("reply")
+	token, id := NewAPIToken()
+	tk := APIToken{ID: id, Scopes: scopes, RateLimit: 10}
+	copy(tk.User[:], "bot")
+
+	if err := store.AddToken(tk); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(path)
+	if x, ok := store.GetToken(token); !ok || x != tk || !x.Can(TOKEN_REPLY) || x.Can(TOKEN_TOPIC) || x.ScopeNames() != "reply" {
+		t.Fatal(x)
+	}
+	if _, ok := store.GetToken(token + "a"); ok {
+		t.FailNow()
+	}
+	assertNotInMainLog(t, path, id[:])
+
+	store.RevokeToken(id)
+	store = openTestStore(path)
+	if x, _ := store.GetToken(token); !x.Revoked || x.Can(TOKEN_REPLY) || store.RevokeToken(id) == nil {
+		t.Fatal(x)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	a, ip := [8]byte{0, 0, 1}, [8]byte{}
+	all, _ := store.Subscribe(0)
+	one, _ := store.Subscribe(1)
+	defer store.Unsubscribe(one)
+
+	op, _ := store.NewTopic("topic 1", "hello world", nil, nil, a, ip, false, false)
+	store.NewTopic("topic 2", "hello world", nil, nil, a, ip, false, false)
+	pending, _ := store.NewPost(1, "pending", nil, nil, a, ip, false, true)
+	store.OperateTopic(1, OP_LOCK)
+	store.ApprovePost(pending)
+
+	for _, e := range []Event{
+		{Type: EventTopic, Topic: 1, LongID: op},
+		{Type: EventUpdate, Topic: 1, Action: "lock"},
+		{Type: EventPost, Topic: 1, LongID: pending},
+	} {
+		if x := <-one.C; x != e {
+			t.Fatal(x, e)
+		}
+	}
+	if len(all.C) != 4 {
+		t.FailNow()
+	}
+
+	// a slow subscriber should be dropped instead of blocking writers
+	for i := 0; i < subscriberBuffer; i++ {
+		store.OperateTopic(2, OP_SAGE)
+	}
+	for range all.C {
+	}
+	if !all.Dropped || len(one.C) != 0 {
+		t.FailNow()
+	}
+	store.Unsubscribe(all)
+}
+
+func TestTripcode(t *testing.T) {
+	salt := MakeSalt("test")
+	a, b := MakeTripcode("bob#secret", salt), MakeTripcode("alice#secret", salt)
+	if a == nil || a.Name != "bob" || a.Code != b.Code || len(a.Code) != 8 {
+		t.Fatal(a, b)
+	}
+	if c := MakeTripcode("bob#secret2", salt); c.Code == a.Code {
+		t.Fatal(c)
+	}
+	if MakeTripcode("bob", salt) != nil || MakeTripcode("bob#", salt) != nil {
+		t.FailNow()
+	}
+}
+
+func TestAdminCredential(t *testing.T) {
+	// test vectors from RFC 6238
+	for step, code := range map[int64]string{59 / 30: "287082", 1111111109 / 30: "081804"} {
+		if c, _ := TOTPCode("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", step); c != code {
+			t.Fatal(step, c)
+		}
+	}
+
+	c := &AdminCredential{}
+	c.SetPassword("hunter2")
+	if !c.Verify("hunter2", "") || c.Verify("hunter3", "") {
+		t.FailNow()
+	}
+
+	c.NewTOTPSecret()
+	code, _ := TOTPCode(c.TOTPSecret, time.Now().Unix()/30)
+	if c.Verify("hunter2", "") || !c.Verify("hunter2", code) || c.Verify("hunter3", code) {
+		t.FailNow()
+	}
+}
+
+func TestRekey(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	user, ip := [8]byte{0, 0, 1, 2, 3, 4, 5, 6}, [8]byte{0, 0, 6, 5, 4, 3, 2, 1}
+	store.NewTopic("first", "hello world", nil, nil, user, ip, false, false)
+	store.NewTopic("second", "hello world", nil, nil, user, ip, false, false)
+	store.SetMaxLiveTopics(1)
+	store.LogModAction(ModAction{CreatedAt: 1, Actor: user, Action: "archive", Target: "1"})
+
+	key := [16]byte{1}
+	if err := store.Rekey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(path, key)
+	if _, total := store.GetModActions(0, 1, nil); total != 1 {
+		t.Fatal(total)
+	}
+	topic := store.GetTopic(2, DefaultTopicMapper)
+	if p := topic.Posts[0]; p.UserXor() != user || p.IPXor() != ip {
+		t.Fatal(p.UserXor(), p.IPXor())
+	}
+
+	topic, err := store.LoadArchivedTopic(1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := topic.Posts[0]; p.UserXor() != user || p.IPXor() != ip {
+		t.Fatal(p.UserXor(), p.IPXor())
+	}
+}
+
+func TestIPRange(t *testing.T) {
+	v6 := EncodeIP(net.ParseIP("2001:db8:1:2:3:4:5:6"), 48)
+	if v6 != EncodeIP(net.ParseIP("2001:db8:1:ffff::1"), 48) {
+		t.Fatal(v6)
+	}
+
+	for _, c := range []struct {
+		cidr, ip string
+		match    bool
+	}{
+		{"1.2.0.0/16", "1.2.3.4", true},
+		{"1.2.0.0/16", "1.3.3.4", false},
+		{"1.2.3.0/28", "1.2.3.200", true},
+		{"2001:db8::/32", "2001:db8:abcd::1", true},
+		{"2001:db8::/32", "2001:db9::1", false},
+		{"2001:db8::/32", "1.2.3.4", false},
+		{"0.0.0.0/0", "2001:db8::1", false},
+	} {
+		term, bits, err := ParseIPRange(c.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matchIPRange(term, bits, EncodeIP(net.ParseIP(c.ip), 64)) != c.match {
+			t.Fatal(c.cidr, c.ip)
+		}
+		if term2, bits2, _ := ParseIPRange(FormatIPRange(term, bits)); term2 != term || bits2 != bits {
+			t.Fatal(c.cidr, FormatIPRange(term, bits))
+		}
+	}
+
+	ip, _ := Format8Bytes(v6)
+	if Parse8Bytes(ip) != v6 {
+		t.Fatal(ip)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const passwordRounds = 100000
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// AdminCredential is the login of the admin, it is kept outside of main.txt because snapshots of main.txt are public
+type AdminCredential struct {
+	Hash       string // rounds$salt$hash
+	TOTPSecret string // base32 encoded, empty if TOTP is disabled
+}
+
+func hashPassword(password string, salt []byte, rounds int) []byte {
+	x := sha256.Sum256(append(salt, password...))
+	for i := 1; i < rounds; i++ {
+		x = sha256.Sum256(append(x[:], salt...))
+	}
+	return x[:]
+}
+
+// SetPassword replaces the password hash with a freshly salted one
+func (c *AdminCredential) SetPassword(password string) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	c.Hash = fmt.Sprintf("%d$%x$%x", passwordRounds, salt, hashPassword(password, salt, passwordRounds))
+}
+
+// NewTOTPSecret generates and sets a new TOTP secret
+func (c *AdminCredential) NewTOTPSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	c.TOTPSecret = totpEncoding.EncodeToString(secret)
+	return c.TOTPSecret
+}
+
+// Verify checks the password, and the TOTP code if TOTP is enabled
+func (c *AdminCredential) Verify(password, code string) bool {
+	parts := strings.Split(c.Hash, "$")
+	if len(parts) != 3 {
+		return false
+	}
+
+	rounds, _ := strconv.Atoi(parts[0])
+	salt, err1 := hex.DecodeString(parts[1])
+	hash, err2 := hex.DecodeString(parts[2])
+	if rounds <= 0 || err1 != nil || err2 != nil {
+		return false
+	}
+
+	if subtle.ConstantTimeCompare(hashPassword(password, salt, rounds), hash) != 1 {
+		return false
+	}
+
+	if c.TOTPSecret == "" {
+		return true
+	}
+
+	// allow the code of the previous and the next time step to tolerate clock drifts
+	now := time.Now().Unix() / 30
+	for _, step := range []int64{now - 1, now, now + 1} {
+		if expected, err := TOTPCode(c.TOTPSecret, step); err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPURI returns the otpauth URI which can be imported by authenticator apps
+func (c *AdminCredential) TOTPURI(issuer string) string {
+	return fmt.Sprintf("otpauth://totp/%s:admin?secret=%s&issuer=%s", issuer, c.TOTPSecret, issuer)
+}
+
+// TOTPCode computes the 6 digits code of RFC 6238 for the given 30s time step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000), nil
+}
+
+// LoadAdminCredential reads the credential file in the format of "hash|totp secret"
+func LoadAdminCredential(path string) (*AdminCredential, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(buf)), "|")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid credential file: %s", path)
+	}
+	return &AdminCredential{Hash: parts[0], TOTPSecret: parts[1]}, nil
+}
+
+func (c *AdminCredential) Save(path string) error {
+	return ioutil.WriteFile(path, []byte(c.Hash+"|"+c.TOTPSecret), 0600)
+}
@@ -0,0 +1,94 @@
+package server
+
+import "fmt"
+
+// EventUpdate is published when a topic or a post is changed by moderation, Action tells what has been done
+const EventUpdate = "update"
+
+const (
+	maxSubscribers   = 1024
+	subscriberBuffer = 32
+)
+
+// Event is a change committed to the store, which is pushed to live readers
+type Event struct {
+	Type   string `json:"type"`
+	Topic  uint32 `json:"topic"`
+	LongID uint64 `json:"longid,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+// Subscriber receives events from C, a slow subscriber will be dropped instead of blocking the store,
+// in which case C is closed and Dropped is set
+type Subscriber struct {
+	C       chan Event
+	Dropped bool
+	topic   uint32 // 0 means all topics
+}
+
+// Subscribe returns a subscriber of events of the topic, or of all topics if topicID is 0
+func (store *Store) Subscribe(topicID uint32) (*Subscriber, error) {
+	store.subLock.Lock()
+	defer store.subLock.Unlock()
+
+	if len(store.subscribers) >= maxSubscribers {
+		return nil, fmt.Errorf("too many subscribers")
+	}
+
+	s := &Subscriber{C: make(chan Event, subscriberBuffer), topic: topicID}
+	store.subscribers[s] = true
+	return s, nil
+}
+
+func (store *Store) Unsubscribe(s *Subscriber) {
+	store.subLock.Lock()
+	defer store.subLock.Unlock()
+
+	if store.subscribers[s] {
+		delete(store.subscribers, s)
+		close(s.C)
+	}
+}
+
+// publish never blocks, it is called by writers while holding the store lock
+func (store *Store) publish(e Event) {
+	store.subLock.Lock()
+	defer store.subLock.Unlock()
+
+	for s := range store.subscribers {
+		if s.topic != 0 && s.topic != e.Topic {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+			delete(store.subscribers, s)
+			s.Dropped = true
+			close(s.C)
+		}
+	}
+}
+
+// publishPost publishes a post which just becomes visible
+func (store *Store) publishPost(p *Post) {
+	if p.ID == 1 {
+		store.publish(Event{Type: EventTopic, Topic: p.Topic.ID, LongID: p.LongID()})
+	} else {
+		store.publish(Event{Type: EventPost, Topic: p.Topic.ID, LongID: p.LongID()})
+	}
+}
+
+var eventActions = map[byte]string{
+	OP_STICKY:    "sticky",
+	OP_LOCK:      "lock",
+	OP_FREEREPLY: "free-reply",
+	OP_SAGE:      "sage",
+	OP_PURGE:     "purge",
+	OP_NSFW:      "nsfw",
+	OP_APPEND:    "append",
+}
+
+// publishUpdate publishes a moderation change of the topic, or of the post if postLongID is not 0
+func (store *Store) publishUpdate(topicID uint32, postLongID uint64, op byte) {
+	store.publish(Event{Type: EventUpdate, Topic: topicID, LongID: postLongID, Action: eventActions[op]})
+}
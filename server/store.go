@@ -39,6 +39,27 @@ const (
 	OP_CONFIG    = 'C'
 	OP_MAXTOPICS = 'M'
 	OP_NSFW      = 'W'
+	OP_BAN       = 'K'
+	OP_UNBAN     = 'k'
+	OP_RANGE     = 'R'
+	OP_UNRANGE   = 'r'
+	OP_APPROVE   = 'V'
+	OP_REPORT    = 'Q'
+	OP_RESOLVE   = 'q'
+	OP_MODLOG    = 'g'
+	OP_SESSION   = 'h'
+	OP_REVOKE    = 'j'
+	OP_TRIP      = 'p'
+	OP_INVITE    = 'n'
+	OP_REDEEM    = 'u'
+	OP_NAMEREQ   = 'y'
+	OP_NAMEOK    = 'Y'
+	OP_NAMEDEL   = 'Z'
+	OP_WATCH     = 'w'
+	OP_UNWATCH   = 'v'
+	OP_TOKEN     = 'o'
+	OP_UNTOKEN   = 'O'
+	OP_FILTER    = 'f'
 )
 
 // Store describes store
@@ -54,12 +75,28 @@ type Store struct {
 	maxLiveTopics int
 	dataFilePath  string
 	configStr     string
+	filterStr     string // FilterConfig of the forum, kept in the private log
 	configLock    sync.RWMutex
 	rootTopic     *Topic
 	endTopic      *Topic
 	topicsCount   uint32
-	blocked       map[[8]byte]bool
+	blocked       map[[8]byte]Ban
+	blockedRanges []Ban
+	reports       map[uint64][]Report
+	modActions    []ModAction
+	sessions      []Session
+	revoked       map[[8]byte][]Revocation
+	invites       []Invite
+	members       map[[8]byte]*Member
+	inbox         map[[8]byte][]InboxEntry
+	watches       map[[8]byte]map[uint32]uint16 // ID -> topic ID -> number of posts seen
+	seenDirty     map[watchKey]bool             // seen counters not written yet, see FlushWatches
+	tokens        []APIToken
 	dataFile      *os.File
+	privateFile   *os.File
+	privatePtr    int64
+	subLock       sync.Mutex
+	subscribers   map[*Subscriber]bool
 }
 
 func (store *Store) LoadingProgress() float64 { return float64(atomic.LoadUintptr(&store.ready)) / 1000 }
@@ -68,14 +105,25 @@ func (store *Store) IsReady() bool { return atomic.LoadUintptr(&store.ready) ==
 
 func (store *Store) MaxLiveTopics() int { return store.maxLiveTopics }
 
+// markBlockedOrUnblocked replays the legacy OP_BLOCK which toggles a permanent ban
 func (store *Store) markBlockedOrUnblocked(term [8]byte) {
-	if store.blocked[term] {
+	if _, ok := store.blocked[term]; ok {
 		delete(store.blocked, term)
 	} else {
-		store.blocked[term] = true
+		store.blocked[term] = Ban{Term: term}
 	}
 }
 
+func (store *Store) removeBannedRange(term [8]byte, bits byte) bool {
+	for i, b := range store.blockedRanges {
+		if b.Term == term && b.Bits == bits {
+			store.blockedRanges = append(store.blockedRanges[:i], store.blockedRanges[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func (store *Store) OperateTopic(topicID uint32, action byte) error {
 	store.Lock()
 	defer store.Unlock()
@@ -111,6 +159,9 @@ func (store *Store) OperateTopic(topicID uint32, action byte) error {
 			store.LiveTopicsNum--
 		}
 	}
+	if err == nil {
+		store.publishUpdate(topicID, 0, action)
+	}
 	return err
 }
 
@@ -121,7 +172,7 @@ func (store *Store) SageTopic(topicID uint32, u User) error {
 	if t == nil {
 		return ErrInvalidTopic
 	}
-	if !u.Can(PERM_LOCK_SAGE_DELETE_FLAG) && u.ID != t.Posts[0].UserXor() {
+	if !u.Can(CAP_SAGE) && u.ID != t.Posts[0].UserXor() {
 		return fmt.Errorf("can't sage the topic")
 	}
 
@@ -131,6 +182,7 @@ func (store *Store) SageTopic(topicID uint32, u User) error {
 	}
 
 	t.Saged = !t.Saged
+	store.publishUpdate(topicID, 0, OP_SAGE)
 	return nil
 }
 
@@ -226,6 +278,7 @@ func (store *Store) AppendPost(postLongID uint64, msg string) error {
 	}
 
 	post.Message += msg
+	store.publishUpdate(post.Topic.ID, postLongID, OP_APPEND)
 	return nil
 }
 
@@ -263,7 +316,7 @@ func (store *Store) moveTopicToFront(topic *Topic) {
 
 var errTooManyPosts = fmt.Errorf("too many posts")
 
-func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, topic *Topic, sage bool) (uint64, error) {
+func (store *Store) addNewPost(msg string, image *Image, trip *Tripcode, user, ipAddr [8]byte, topic *Topic, sage, pending bool) (uint64, error) {
 	newTopic := len(topic.Posts) == 0
 	nextID := len(topic.Posts) + 1
 	if nextID > 4000 {
@@ -278,6 +331,7 @@ func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, t
 		Topic:     topic,
 		Message:   msg,
 		Image:     image,
+		Trip:      trip,
 	}
 
 	if newTopic {
@@ -291,6 +345,10 @@ func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, t
 		p.SetStatus(POST_ISSAGE)
 	}
 
+	if pending {
+		p.SetStatus(POST_ISPENDING)
+	}
+
 	var topicStr buffer
 	if newTopic {
 		topicStr.WriteByte(OP_TOPIC)
@@ -322,13 +380,18 @@ func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, t
 			WriteUInt16(image.Y)
 	}
 
+	if trip != nil {
+		trip.marshal(&topicStr, topic.ID, p.ID)
+	}
+
 	if err := store.append(topicStr.Bytes()); err != nil {
 		return 0, err
 	}
 
 	topic.Posts = append(topic.Posts, *p)
+	store.indexReferencesUnlocked(&topic.Posts[len(topic.Posts)-1], store.topicByIDUnlocked)
 
-	if !sage || newTopic {
+	if (!sage && !pending) || newTopic {
 		// as a new topic, even it is saged, it still has the opportunity to stay at the top for once
 		store.moveTopicToFront(topic)
 	}
@@ -338,6 +401,9 @@ func (store *Store) addNewPost(msg string, image *Image, user, ipAddr [8]byte, t
 	} else {
 		topic.ModifiedAt = p.CreatedAt
 	}
+	if !pending {
+		store.publishPost(p)
+	}
 	return p.LongID(), nil
 }
 
@@ -371,6 +437,10 @@ func (topic *Topic) marshal() buffer {
 				WriteUInt16(p.Image.Y)
 		}
 
+		if p.Trip != nil {
+			p.Trip.marshal(&buf, topic.ID, p.ID)
+		}
+
 		if p.T_IsNSFW() {
 			buf.WriteByte(OP_NSFW).
 				WriteUInt32(topic.ID).
@@ -442,7 +512,7 @@ func (store *Store) archiveJob(maxLiveTopics int) error {
 	return nil
 }
 
-func (store *Store) NewTopic(subject, msg string, image *Image, user, ipAddr [8]byte, sage bool) (uint64, error) {
+func (store *Store) NewTopic(subject, msg string, image *Image, trip *Tripcode, user, ipAddr [8]byte, sage, pending bool) (uint64, error) {
 	store.Lock()
 	defer store.Unlock()
 
@@ -457,7 +527,7 @@ func (store *Store) NewTopic(subject, msg string, image *Image, user, ipAddr [8]
 		store:   store,
 	}
 
-	postLongID, err := store.addNewPost(msg, image, user, ipAddr, topic, sage)
+	postLongID, err := store.addNewPost(msg, image, trip, user, ipAddr, topic, sage, pending)
 	if err == nil {
 		store.topicsCount++
 		store.LiveTopicsNum++
@@ -466,7 +536,7 @@ func (store *Store) NewTopic(subject, msg string, image *Image, user, ipAddr [8]
 	return postLongID, err
 }
 
-func (store *Store) NewPost(topicID uint32, msg string, image *Image, user, ipAddr [8]byte, sage bool) (uint64, error) {
+func (store *Store) NewPost(topicID uint32, msg string, image *Image, trip *Tripcode, user, ipAddr [8]byte, sage, pending bool) (uint64, error) {
 	store.Lock()
 	defer store.Unlock()
 
@@ -475,7 +545,7 @@ func (store *Store) NewPost(topicID uint32, msg string, image *Image, user, ipAd
 		return 0, errors.New("invalid topic ID")
 	}
 
-	postLongID, err := store.addNewPost(msg, image, user, ipAddr, topic, sage)
+	postLongID, err := store.addNewPost(msg, image, trip, user, ipAddr, topic, sage, pending)
 	if err == errTooManyPosts {
 		var p buffer
 		if err = store.append(p.WriteByte(OP_LOCK).WriteUInt32(topicID).Bytes()); err == nil {
@@ -541,6 +611,24 @@ func (store *Store) GetPostsBy(q [8]byte, qtext string, max int, timeout int64)
 		return res, total
 	}
 
+	if strings.HasPrefix(qtext, TripPrefix) {
+		code := strings.TrimPrefix(qtext, TripPrefix)
+		start := time.Now().UnixNano()
+		for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
+			if time.Now().UnixNano()-start > timeout {
+				break
+			}
+			for _, post := range topic.Posts {
+				if post.Trip != nil && post.Trip.Code == code {
+					if total++; total <= max {
+						res = append(res, post)
+					}
+				}
+			}
+		}
+		return res, total
+	}
+
 	if strings.HasPrefix(qtext, "!!") {
 		for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
 			if strings.HasPrefix(topic.Subject, qtext) {
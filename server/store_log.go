@@ -2,10 +2,13 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 	"sync"
@@ -96,6 +99,184 @@ func parseNSFW(r *buffer, topicIDToTopic map[uint32]*Topic) {
 	p.T_InvertStatus(POST_T_ISNSFW)
 }
 
+func parseBan(r *buffer) Ban {
+	term, err := r.Read8Bytes()
+	panicif(err != nil, "invalid object to ban")
+
+	mod, err := r.Read8Bytes()
+	panicif(err != nil, "invalid moderator")
+
+	createdAt, err := r.ReadUInt32()
+	panicif(err != nil, "invalid timestamp")
+
+	until, err := r.ReadUInt32()
+	panicif(err != nil, "invalid expiry")
+
+	reason, err := r.ReadString()
+	panicif(err != nil, "invalid reason")
+
+	return Ban{
+		Term:      term,
+		Mod:       mod,
+		CreatedAt: createdAt,
+		Until:     until,
+		Reason:    reason,
+	}
+}
+
+func parseModAction(r *buffer) ModAction {
+	createdAt, err := r.ReadUInt32()
+	panicif(err != nil, "invalid timestamp")
+
+	actor, err := r.Read8Bytes()
+	panicif(err != nil, "invalid actor")
+
+	action, err := r.ReadString()
+	panicif(err != nil, "invalid action")
+
+	target, err := r.ReadString()
+	panicif(err != nil, "invalid target")
+
+	reason, err := r.ReadString()
+	panicif(err != nil, "invalid reason")
+
+	return ModAction{
+		CreatedAt: createdAt,
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Reason:    reason,
+	}
+}
+
+func parseSession(r *buffer) Session {
+	id, err := r.Read8Bytes()
+	panicif(err != nil, "invalid session ID")
+
+	t, err := r.ReadUInt32()
+	panicif(err != nil, "invalid timestamp")
+
+	m, err := r.ReadByte()
+	panicif(err != nil, "invalid permission")
+
+	role, err := r.ReadByte()
+	panicif(err != nil, "invalid role")
+
+	issuer, err := r.Read8Bytes()
+	panicif(err != nil, "invalid issuer")
+
+	return Session{ID: id, T: int64(t), M: m, R: role, Issuer: issuer}
+}
+
+func parseRevocation(r *buffer) Revocation {
+	id, err := r.Read8Bytes()
+	panicif(err != nil, "invalid revocation ID")
+
+	t, err := r.ReadUInt32()
+	panicif(err != nil, "invalid timestamp")
+
+	createdAt, err := r.ReadUInt32()
+	panicif(err != nil, "invalid timestamp")
+
+	return Revocation{ID: id, T: int64(t), CreatedAt: createdAt}
+}
+
+func parseTrip(r *buffer, topicIDToTopic map[uint32]*Topic) {
+	p, err := findPost(r, topicIDToTopic)
+	panicif(err != nil, err)
+
+	name, err := r.ReadString()
+	panicif(err != nil, "invalid trip name")
+
+	code, err := r.ReadString()
+	panicif(err != nil, "invalid trip code")
+
+	p.Trip = &Tripcode{Name: name, Code: code}
+}
+
+func parseInvite(r *buffer) Invite {
+	id, err := r.Read8Bytes()
+	panicif(err != nil, "invalid invite ID")
+
+	creator, err := r.Read8Bytes()
+	panicif(err != nil, "invalid creator")
+
+	createdAt, err := r.ReadUInt32()
+	panicif(err != nil, "invalid timestamp")
+
+	maxUses, err := r.ReadUInt16()
+	panicif(err != nil, "invalid max uses")
+
+	return Invite{ID: id, Creator: creator, CreatedAt: createdAt, MaxUses: maxUses}
+}
+
+func (store *Store) parseRedeem(r *buffer) {
+	id, err := r.Read8Bytes()
+	panicif(err != nil, "invalid invite ID")
+
+	user, err := r.Read8Bytes()
+	panicif(err != nil, "invalid user")
+
+	createdAt, err := r.ReadUInt32()
+	panicif(err != nil, "invalid timestamp")
+
+	inv := store.findInviteUnlocked(id)
+	panicif(inv == nil, "can't find the invite: %x", id)
+	inv.Uses = append(inv.Uses, InviteUse{User: user, CreatedAt: createdAt})
+}
+
+func parseToken(r *buffer) APIToken {
+	id, err := r.Read8Bytes()
+	panicif(err != nil, "invalid token ID")
+
+	user, err := r.Read8Bytes()
+	panicif(err != nil, "invalid user")
+
+	creator, err := r.Read8Bytes()
+	panicif(err != nil, "invalid creator")
+
+	createdAt, err := r.ReadUInt32()
+	panicif(err != nil, "invalid timestamp")
+
+	scopes, err := r.ReadByte()
+	panicif(err != nil, "invalid scopes")
+
+	limit, err := r.ReadUInt16()
+	panicif(err != nil, "invalid rate limit")
+
+	return APIToken{ID: id, User: user, Creator: creator, CreatedAt: createdAt, Scopes: scopes, RateLimit: limit}
+}
+
+func (store *Store) parseName(op byte, r *buffer) {
+	id, err := r.Read8Bytes()
+	panicif(err != nil, "invalid member ID")
+
+	m := store.members[id]
+	if m == nil {
+		m = &Member{ID: id}
+		store.members[id] = m
+	}
+
+	switch op {
+	case OP_NAMEREQ:
+		name, err := r.ReadString()
+		panicif(err != nil, "invalid name")
+		at, err := r.ReadUInt32()
+		panicif(err != nil, "invalid timestamp")
+		m.Requested, m.RequestedAt = name, at
+	case OP_NAMEOK:
+		approver, err := r.Read8Bytes()
+		panicif(err != nil, "invalid approver")
+		at, err := r.ReadUInt32()
+		panicif(err != nil, "invalid timestamp")
+		m.Name, m.ApprovedAt, m.Approver, m.Requested = m.Requested, at, approver, ""
+	case OP_NAMEDEL:
+		which, err := r.ReadByte()
+		panicif(err != nil, "invalid name to delete")
+		m.deleteName(which)
+	}
+}
+
 func parsePost(r *buffer, topicIDToTopic map[uint32]*Topic) Post {
 	topicID, err := r.ReadUInt32()
 	panicif(err != nil, "invalid topic ID")
@@ -216,12 +397,13 @@ func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err e
 			post := parsePost(r, topicIDToTopic)
 			t := post.Topic
 			t.Posts = append(t.Posts, post)
+			store.indexReferencesUnlocked(&t.Posts[len(t.Posts)-1], func(id uint32) *Topic { return topicIDToTopic[id] })
 			if len(t.Posts) == 1 {
 				t.CreatedAt = post.CreatedAt
 			} else {
 				t.ModifiedAt = post.CreatedAt
 			}
-			if !post.IsSaged() {
+			if !post.IsSaged() && !post.IsPending() {
 				store.moveTopicToFront(t)
 			}
 		case OP_APPEND:
@@ -232,12 +414,21 @@ func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err e
 			post.Message += msg
 		case OP_IMAGE:
 			parseImage(r, topicIDToTopic)
+		case OP_TRIP:
+			parseTrip(r, topicIDToTopic)
 		case OP_NSFW:
 			parseNSFW(r, topicIDToTopic)
 		case OP_DELETE:
 			post, err := findPost(r, topicIDToTopic)
 			panicif(err != nil, err)
 			post.InvertStatus(POST_ISDELETE)
+		case OP_APPROVE:
+			post, err := findPost(r, topicIDToTopic)
+			panicif(err != nil, err)
+			post.UnsetStatus(POST_ISPENDING)
+			if !post.IsSaged() {
+				store.moveTopicToFront(post.Topic)
+			}
 		case OP_BLOCK:
 			str, err := r.Read8Bytes()
 			panicif(err != nil, "invalid object to block")
@@ -280,10 +471,20 @@ func (store *Store) loadDB(path string, slient bool, onload func(*Store)) (err e
 		case OP_NOP:
 			// do nothing
 		default:
-			panicif(true, "unexpected line type: %s(%x)", string(op), op)
+			// old stores have private records in the main log
+			panicif(!store.replayPrivate(op, r, topicIDToTopic), "unexpected line type: %s(%x)", string(op), op)
 		}
 	}
 
+	// check before the store is ready, writers may come in afterwards
+	for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
+		panicif(0 == len(topic.Posts), "topic %d has no posts!", topic.ID)
+	}
+
+	if store.privateFile != nil {
+		store.loadPrivate(topicIDToTopic)
+	}
+
 	testConfig := map[string]interface{}{}
 	if err := store.GetConfig(&testConfig); err != nil {
 		panicif(true, err)
@@ -302,7 +503,14 @@ func NewStore(path string, password [16]byte, onload func(*Store)) *Store {
 		dataFilePath:  path,
 		rootTopic:     &Topic{},
 		endTopic:      &Topic{},
-		blocked:       make(map[[8]byte]bool),
+		blocked:       make(map[[8]byte]Ban),
+		reports:       make(map[uint64][]Report),
+		revoked:       make(map[[8]byte][]Revocation),
+		members:       make(map[[8]byte]*Member),
+		inbox:         make(map[[8]byte][]InboxEntry),
+		watches:       make(map[[8]byte]map[uint32]uint16),
+		seenDirty:     make(map[watchKey]bool),
+		subscribers:   make(map[*Subscriber]bool),
 		Rand:          rand.New(),
 		maxLiveTopics: 1024,
 	}
@@ -320,12 +528,12 @@ func NewStore(path string, password [16]byte, onload func(*Store)) *Store {
 		f.Close()
 	}
 	go func() {
-		store.loadDB(store.dataFilePath, false, onload)
-		for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
-			panicif(0 == len(topic.Posts), "topic %d has no posts!", topic.ID)
-		}
+		// open the file before loading, so it is writable once the store is ready
 		store.dataFile, err = os.OpenFile(store.dataFilePath, os.O_RDWR, 0666)
 		panicif(err != nil, "can't open DB %s: %v", store.dataFilePath, err)
+		store.privateFile, err = os.OpenFile(store.privateFilePath(), os.O_RDWR|os.O_CREATE, 0600)
+		panicif(err != nil, "can't open private DB %s: %v", store.privateFilePath(), err)
+		store.loadDB(store.dataFilePath, false, onload)
 	}()
 
 	if false {
@@ -351,10 +559,10 @@ func NewStore(path string, password [16]byte, onload func(*Store)) *Store {
 					}
 
 					if r.Intn(10) == 1 {
-						longID, _ := store.NewTopic(subject, msg, img, userName, ipAddr, false)
+						longID, _ := store.NewTopic(subject, msg, img, nil, userName, ipAddr, false, false)
 						curTopicId, _ = SplitID(longID)
 					} else if curTopicId > 0 {
-						store.NewPost(uint32(r.Intn(int(curTopicId))+1), msg, img, userName, ipAddr, false)
+						store.NewPost(uint32(r.Intn(int(curTopicId))+1), msg, img, nil, userName, ipAddr, false, false)
 					}
 					wg.Done()
 				}()
@@ -373,26 +581,34 @@ func (store *Store) LoadArchivedTopic(topicID uint32, password [16]byte) (Topic,
 		return Topic{}, err
 	}
 
+	block, _ := aes.NewCipher(password[:])
+	t, err := loadArchive(path, block)
+	if err != nil {
+		return Topic{}, err
+	}
+	return *t, nil
+}
+
+func loadArchive(path string, block cipher.Block) (*Topic, error) {
 	// create a dummy store to load a single topic
-	store = &Store{
+	store := &Store{
 		rootTopic: &Topic{},
 		endTopic:  &Topic{},
+		block:     block,
 	}
 
 	store.rootTopic.Next = store.endTopic
 	store.endTopic.Prev = store.rootTopic
-	store.block, _ = aes.NewCipher(password[:])
 
-	var err error
-	if err = store.loadDB(path, true, nil); err != nil {
-		return Topic{}, err
+	if err := store.loadDB(path, true, nil); err != nil {
+		return nil, err
 	}
 
 	if store.rootTopic.Next == store.endTopic {
-		return Topic{}, fmt.Errorf("no topic in %s", path)
+		return nil, fmt.Errorf("no topic in %s", path)
 	}
 
-	return *store.rootTopic.Next, nil
+	return store.rootTopic.Next, nil
 }
 
 // append writes data onto disk with WAL
@@ -446,3 +662,129 @@ func (store *Store) append(buf []byte) error {
 	store.ptr = newptr
 	return nil
 }
+
+// privateFilePath is the log of records which must not be published along with the main log,
+// like who moderates, reports or watches what
+func (store *Store) privateFilePath() string {
+	return store.dataFilePath + ".private"
+}
+
+// appendPrivate writes data onto the private log, each record is prefixed by its length,
+// so a torn record at the end can be found and cut off when loading
+func (store *Store) appendPrivate(buf []byte) error {
+	var p buffer
+	n, err := store.privateFile.WriteAt(append(p.WriteUInt32(uint32(len(buf))).Bytes(), buf...), store.privatePtr)
+	if err != nil {
+		return err
+	}
+	store.privatePtr += int64(n)
+	return nil
+}
+
+// loadPrivate replays the private log, it must be called after the main log is loaded
+func (store *Store) loadPrivate(topicIDToTopic map[uint32]*Topic) {
+	buf, err := ioutil.ReadFile(store.privateFilePath())
+	panicif(err != nil, "can't read private DB: %v", err)
+
+	store.privatePtr = 0
+	for int64(len(buf))-store.privatePtr >= 4 {
+		start := store.privatePtr + 4
+		end := start + int64(binary.BigEndian.Uint32(buf[store.privatePtr:]))
+		if end > int64(len(buf)) {
+			break
+		}
+
+		r := &buffer{}
+		r.SetReader(bytes.NewReader(buf[start:end]))
+		op, err := r.ReadByte()
+		panicif(err != nil, "invalid private record at %d", store.privatePtr)
+		panicif(!store.replayPrivate(op, r, topicIDToTopic), "unexpected private record type: %s(%x)", string(op), op)
+		store.privatePtr = end
+	}
+
+	if store.privatePtr < int64(len(buf)) {
+		panicif(store.privateFile.Truncate(store.privatePtr) != nil, "can't truncate private DB")
+	}
+}
+
+// replayPrivate applies a record which can be found in the private log, returns false if op is not such a record
+func (store *Store) replayPrivate(op byte, r *buffer, topicIDToTopic map[uint32]*Topic) bool {
+	switch op {
+	case OP_MODLOG:
+		store.modActions = append(store.modActions, parseModAction(r))
+	case OP_BAN:
+		b := parseBan(r)
+		store.blocked[b.Term] = b
+	case OP_UNBAN:
+		str, err := r.Read8Bytes()
+		panicif(err != nil, "invalid object to unban")
+		delete(store.blocked, str)
+	case OP_RANGE:
+		bits, err := r.ReadByte()
+		panicif(err != nil || bits == 0 || bits > 64, "invalid range")
+		b := parseBan(r)
+		b.Bits = bits
+		store.removeBannedRange(b.Term, b.Bits)
+		store.blockedRanges = append(store.blockedRanges, b)
+	case OP_UNRANGE:
+		bits, err := r.ReadByte()
+		panicif(err != nil, "invalid range")
+		str, err := r.Read8Bytes()
+		panicif(err != nil, "invalid range to unban")
+		store.removeBannedRange(str, bits)
+	case OP_REPORT:
+		post, postErr := findPost(r, topicIDToTopic)
+		reporter, err := r.Read8Bytes()
+		panicif(err != nil, "invalid reporter")
+		createdAt, err := r.ReadUInt32()
+		panicif(err != nil, "invalid timestamp")
+		reason, err := r.ReadString()
+		panicif(err != nil, "invalid reason")
+		// the topic may have been archived after the report
+		if postErr == nil {
+			store.addReport(post.LongID(), Report{Reporter: reporter, CreatedAt: createdAt, Reason: reason})
+		}
+	case OP_RESOLVE:
+		if post, err := findPost(r, topicIDToTopic); err == nil {
+			delete(store.reports, post.LongID())
+		}
+	case OP_SESSION:
+		store.sessions = append(store.sessions, parseSession(r))
+	case OP_REVOKE:
+		rv := parseRevocation(r)
+		store.revoked[rv.ID] = append(store.revoked[rv.ID], rv)
+	case OP_INVITE:
+		store.invites = append(store.invites, parseInvite(r))
+	case OP_REDEEM:
+		store.parseRedeem(r)
+	case OP_NAMEREQ, OP_NAMEOK, OP_NAMEDEL:
+		store.parseName(op, r)
+	case OP_FILTER:
+		fs, err := r.ReadString()
+		panicif(err != nil, err)
+		store.filterStr = fs
+	case OP_TOKEN:
+		store.tokens = append(store.tokens, parseToken(r))
+	case OP_UNTOKEN:
+		id, err := r.Read8Bytes()
+		panicif(err != nil, "invalid token ID")
+		t := store.findTokenUnlocked(id)
+		panicif(t == nil, "can't find the token: %x", id)
+		t.Revoked = true
+	case OP_WATCH, OP_UNWATCH:
+		id, err := r.Read8Bytes()
+		panicif(err != nil, "invalid watcher")
+		topicID, err := r.ReadUInt32()
+		panicif(err != nil, "invalid topic ID")
+		if op == OP_UNWATCH {
+			delete(store.watches[id], topicID)
+			break
+		}
+		seen, err := r.ReadUInt16()
+		panicif(err != nil, "invalid seen counter")
+		store.setWatchUnlocked(id, topicID, seen)
+	default:
+		return false
+	}
+	return true
+}
@@ -1,31 +1,143 @@
 package server
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coyove/fofou/markup"
 )
 
-// BlockIP blocks/unblocks IP address
-func (store *Store) Block(term [8]byte) error {
+// Ban blocks IP address or user ID until the given time, 0 means forever
+func (store *Store) Ban(term, mod [8]byte, until uint32, reason string) error {
 	store.Lock()
 	defer store.Unlock()
 	if term == default8Bytes {
 		return nil
 	}
-	var p buffer // := fmt.Sprintf("B%s\n", ipAddrInternal)
-	if err := store.append(p.WriteByte(OP_BLOCK).Write8Bytes(term).Bytes()); err != nil {
+
+	b := Ban{
+		Term:      term,
+		Mod:       mod,
+		CreatedAt: uint32(time.Now().Unix()),
+		Until:     until,
+		Reason:    reason,
+	}
+
+	var p buffer
+	if err := store.appendPrivate(b.marshal(&p).Bytes()); err != nil {
 		return err
 	}
-	store.markBlockedOrUnblocked(term)
+	store.blocked[term] = b
 	return nil
 }
 
-// IsBlocked checks if the term is blocked
-func (store *Store) IsBlocked(q [8]byte) bool {
+// Unban lifts the ban on IP address or user ID
+func (store *Store) Unban(term [8]byte) error {
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.blocked[term]; !ok {
+		return nil
+	}
+
+	var p buffer
+	if err := store.appendPrivate(p.WriteByte(OP_UNBAN).Write8Bytes(term).Bytes()); err != nil {
+		return err
+	}
+	delete(store.blocked, term)
+	return nil
+}
+
+// BanRange blocks a range of IP addresses, see ParseIPRange
+func (store *Store) BanRange(term [8]byte, bits int, mod [8]byte, until uint32, reason string) error {
+	store.Lock()
+	defer store.Unlock()
+	if bits <= 0 || bits > 64 {
+		return fmt.Errorf("invalid range length: %d", bits)
+	}
+
+	b := Ban{
+		Term:      maskIP(term, bits),
+		Mod:       mod,
+		CreatedAt: uint32(time.Now().Unix()),
+		Until:     until,
+		Reason:    reason,
+		Bits:      byte(bits),
+	}
+
+	var p buffer
+	if err := store.appendPrivate(b.marshal(&p).Bytes()); err != nil {
+		return err
+	}
+	store.removeBannedRange(b.Term, b.Bits)
+	store.blockedRanges = append(store.blockedRanges, b)
+	return nil
+}
+
+// UnbanRange lifts the ban on a range of IP addresses
+func (store *Store) UnbanRange(term [8]byte, bits int) error {
+	store.Lock()
+	defer store.Unlock()
+	term = maskIP(term, bits)
+
+	var p buffer
+	if err := store.appendPrivate(p.WriteByte(OP_UNRANGE).WriteByte(byte(bits)).Write8Bytes(term).Bytes()); err != nil {
+		return err
+	}
+	store.removeBannedRange(term, byte(bits))
+	return nil
+}
+
+// GetBannedRanges returns all active IP range bans
+func (store *Store) GetBannedRanges() []Ban {
+	store.RLock()
+	defer store.RUnlock()
+	res := make([]Ban, 0, len(store.blockedRanges))
+	for _, b := range store.blockedRanges {
+		if !b.IsExpired() {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+// GetIPBan returns the ban on the IP address, either on itself or on a range it belongs to
+func (store *Store) GetIPBan(ip [8]byte) (Ban, bool) {
+	if b, ok := store.GetBan(ip); ok {
+		return b, true
+	}
+
+	store.RLock()
+	defer store.RUnlock()
+	for _, b := range store.blockedRanges {
+		if !b.IsExpired() && matchIPRange(b.Term, int(b.Bits), ip) {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+// GetBan returns the ban on the term if it hasn't expired yet
+func (store *Store) GetBan(q [8]byte) (Ban, bool) {
 	store.RLock()
 	defer store.RUnlock()
-	return store.blocked[q]
+	b, ok := store.blocked[q]
+	if !ok || b.IsExpired() {
+		return Ban{}, false
+	}
+	return b, true
+}
+
+// IsBlocked checks if the term is blocked
+func (store *Store) IsBlocked(q [8]byte) bool {
+	_, ok := store.GetBan(q)
+	return ok
 }
 
 func (store *Store) DeletePost(u User, postLongID uint64, imageOnly bool, onImageDelete func(*Image)) error {
@@ -37,7 +149,7 @@ func (store *Store) DeletePost(u User, postLongID uint64, imageOnly bool, onImag
 		return err
 	}
 
-	if !u.Can(PERM_LOCK_SAGE_DELETE_FLAG) && u.ID != post.UserXor() {
+	if !u.Can(CAP_DELETE) && u.ID != post.UserXor() {
 		return fmt.Errorf("can't delete the post")
 	}
 
@@ -52,6 +164,11 @@ func (store *Store) DeletePost(u User, postLongID uint64, imageOnly bool, onImag
 	}
 
 	post.InvertStatus(POST_ISDELETE)
+	if post.IsDeleted() {
+		store.publish(Event{Type: EventDelete, Topic: post.Topic.ID, LongID: postLongID})
+	} else {
+		store.publish(Event{Type: EventUpdate, Topic: post.Topic.ID, LongID: postLongID, Action: "restore"})
+	}
 
 	if post.Image != nil {
 		onImageDelete(post.Image)
@@ -59,6 +176,702 @@ func (store *Store) DeletePost(u User, postLongID uint64, imageOnly bool, onImag
 	return nil
 }
 
+// ApprovePost releases a post held for review
+func (store *Store) ApprovePost(postLongID uint64) error {
+	store.Lock()
+	defer store.Unlock()
+
+	post, err := store.getPostPtrUnlocked(postLongID)
+	if err != nil {
+		return err
+	}
+
+	if !post.IsPending() {
+		return nil
+	}
+
+	var p buffer
+	if err := store.append(p.WriteByte(OP_APPROVE).WriteUInt32(post.Topic.ID).WriteUInt16(post.ID).Bytes()); err != nil {
+		return err
+	}
+
+	post.UnsetStatus(POST_ISPENDING)
+	if !post.IsSaged() {
+		store.moveTopicToFront(post.Topic)
+	}
+	store.publishPost(post)
+	return nil
+}
+
+// GetPendingPosts returns posts held for review
+func (store *Store) GetPendingPosts(max int) []Post {
+	store.RLock()
+	defer store.RUnlock()
+
+	res := make([]Post, 0)
+	for topic := store.rootTopic.Next; topic != store.endTopic && len(res) < max; topic = topic.Next {
+		for _, p := range topic.Posts {
+			if p.IsPending() && !p.IsDeleted() {
+				res = append(res, p)
+			}
+		}
+	}
+	return res
+}
+
+func (store *Store) isReportedBy(postLongID uint64, reporter [8]byte) bool {
+	for _, r := range store.reports[postLongID] {
+		if r.Reporter == reporter {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *Store) addReport(postLongID uint64, r Report) {
+	if !store.isReportedBy(postLongID, r.Reporter) {
+		store.reports[postLongID] = append(store.reports[postLongID], r)
+	}
+}
+
+// ReportPost files a report against the post, one reporter can only report a post once
+func (store *Store) ReportPost(postLongID uint64, reporter [8]byte, reason string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	post, err := store.getPostPtrUnlocked(postLongID)
+	if err != nil {
+		return err
+	}
+
+	if store.isReportedBy(postLongID, reporter) {
+		return fmt.Errorf("already reported")
+	}
+
+	r := Report{Reporter: reporter, CreatedAt: uint32(time.Now().Unix()), Reason: reason}
+
+	var p buffer
+	if err := store.appendPrivate(p.WriteByte(OP_REPORT).
+		WriteUInt32(post.Topic.ID).
+		WriteUInt16(post.ID).
+		Write8Bytes(r.Reporter).
+		WriteUInt32(r.CreatedAt).
+		WriteString(r.Reason).Bytes()); err != nil {
+		return err
+	}
+
+	store.addReport(postLongID, r)
+	return nil
+}
+
+// ResolveReports clears all reports against the post
+func (store *Store) ResolveReports(postLongID uint64) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.reports[postLongID]; !ok {
+		return nil
+	}
+
+	post, err := store.getPostPtrUnlocked(postLongID)
+	if err != nil {
+		// the topic has gone, so do the reports
+		delete(store.reports, postLongID)
+		return nil
+	}
+
+	var p buffer
+	if err := store.appendPrivate(p.WriteByte(OP_RESOLVE).WriteUInt32(post.Topic.ID).WriteUInt16(post.ID).Bytes()); err != nil {
+		return err
+	}
+
+	delete(store.reports, postLongID)
+	return nil
+}
+
+// LogModAction appends an entry to the moderation audit log
+func (store *Store) LogModAction(a ModAction) error {
+	store.Lock()
+	defer store.Unlock()
+
+	var p buffer
+	if err := store.appendPrivate(a.marshal(&p).Bytes()); err != nil {
+		return err
+	}
+
+	store.modActions = append(store.modActions, a)
+	return nil
+}
+
+// AddSession records a newly issued privileged cookie
+func (store *Store) AddSession(s Session) error {
+	store.Lock()
+	defer store.Unlock()
+
+	var p buffer
+	if err := store.appendPrivate(s.marshal(&p).Bytes()); err != nil {
+		return err
+	}
+
+	store.sessions = append(store.sessions, s)
+	return nil
+}
+
+// GetSessions returns all issued privileged cookies, newest first
+func (store *Store) GetSessions() []Session {
+	store.RLock()
+	defer store.RUnlock()
+
+	res := make([]Session, 0, len(store.sessions))
+	for i := len(store.sessions) - 1; i >= 0; i-- {
+		s := store.sessions[i]
+		s.Revoked = store.isRevokedUnlocked(s.ID, s.T)
+		res = append(res, s)
+	}
+	return res
+}
+
+// Revoke invalidates the cookie of id created at t, or all cookies of id created until now if t is 0
+func (store *Store) Revoke(id [8]byte, t int64) error {
+	store.Lock()
+	defer store.Unlock()
+
+	r := Revocation{ID: id, T: t, CreatedAt: uint32(time.Now().Unix())}
+
+	var p buffer
+	if err := store.appendPrivate(r.marshal(&p).Bytes()); err != nil {
+		return err
+	}
+
+	store.revoked[id] = append(store.revoked[id], r)
+	return nil
+}
+
+// IsRevoked tells whether the cookie of id created at t has been revoked
+func (store *Store) IsRevoked(id [8]byte, t int64) bool {
+	store.RLock()
+	defer store.RUnlock()
+	return store.isRevokedUnlocked(id, t)
+}
+
+func (store *Store) isRevokedUnlocked(id [8]byte, t int64) bool {
+	for _, r := range store.revoked[id] {
+		if r.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *Store) findInviteUnlocked(id [8]byte) *Invite {
+	for i := range store.invites {
+		if store.invites[i].ID == id {
+			return &store.invites[i]
+		}
+	}
+	return nil
+}
+
+// AddInvite stores a new invite
+func (store *Store) AddInvite(inv Invite) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.findInviteUnlocked(inv.ID) != nil {
+		return fmt.Errorf("invite already existed")
+	}
+
+	var p buffer
+	if err := store.appendPrivate(inv.marshal(&p).Bytes()); err != nil {
+		return err
+	}
+
+	store.invites = append(store.invites, inv)
+	return nil
+}
+
+// RedeemInvite uses the invite code once for the new user
+func (store *Store) RedeemInvite(code string, user [8]byte) error {
+	store.Lock()
+	defer store.Unlock()
+
+	inv := store.findInviteUnlocked(InviteID(code))
+	if inv == nil || len(inv.Uses) >= int(inv.MaxUses) {
+		return fmt.Errorf("invalid invite code")
+	}
+
+	u := InviteUse{User: user, CreatedAt: uint32(time.Now().Unix())}
+
+	var p buffer
+	if err := store.appendPrivate(u.marshal(&p, inv.ID).Bytes()); err != nil {
+		return err
+	}
+
+	inv.Uses = append(inv.Uses, u)
+	return nil
+}
+
+// GetInvites returns all invites, newest first
+func (store *Store) GetInvites() []Invite {
+	store.RLock()
+	defer store.RUnlock()
+
+	res := make([]Invite, 0, len(store.invites))
+	for i := len(store.invites) - 1; i >= 0; i-- {
+		inv := store.invites[i]
+		inv.Uses = append([]InviteUse{}, inv.Uses...)
+		res = append(res, inv)
+	}
+	return res
+}
+
+func (store *Store) findTokenUnlocked(id [8]byte) *APIToken {
+	for i := range store.tokens {
+		if store.tokens[i].ID == id {
+			return &store.tokens[i]
+		}
+	}
+	return nil
+}
+
+// AddToken stores a new API token
+func (store *Store) AddToken(t APIToken) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if store.findTokenUnlocked(t.ID) != nil {
+		return fmt.Errorf("token already existed")
+	}
+
+	var p buffer
+	if err := store.appendPrivate(t.marshal(&p).Bytes()); err != nil {
+		return err
+	}
+
+	store.tokens = append(store.tokens, t)
+	return nil
+}
+
+// RevokeToken disables the API token permanently
+func (store *Store) RevokeToken(id [8]byte) error {
+	store.Lock()
+	defer store.Unlock()
+
+	t := store.findTokenUnlocked(id)
+	if t == nil || t.Revoked {
+		return fmt.Errorf("invalid token")
+	}
+
+	var p buffer
+	if err := store.appendPrivate(p.WriteByte(OP_UNTOKEN).Write8Bytes(id).Bytes()); err != nil {
+		return err
+	}
+
+	t.Revoked = true
+	return nil
+}
+
+// GetToken finds the API token, revoked tokens are returned as well
+func (store *Store) GetToken(token string) (APIToken, bool) {
+	store.RLock()
+	defer store.RUnlock()
+
+	if t := store.findTokenUnlocked(InviteID(token)); t != nil {
+		return *t, true
+	}
+	return APIToken{}, false
+}
+
+// GetTokens returns all API tokens, newest first
+func (store *Store) GetTokens() []APIToken {
+	store.RLock()
+	defer store.RUnlock()
+
+	res := make([]APIToken, 0, len(store.tokens))
+	for i := len(store.tokens) - 1; i >= 0; i-- {
+		res = append(res, store.tokens[i])
+	}
+	return res
+}
+
+const (
+	nameRequest = iota // the pending name
+	nameApproved
+)
+
+func (m *Member) deleteName(which byte) {
+	if which == nameApproved {
+		m.Name, m.ApprovedAt, m.Approver = "", 0, [8]byte{}
+	} else {
+		m.Requested, m.RequestedAt = "", 0
+	}
+}
+
+// nameTakenUnlocked checks whether the name has been registered or requested by other IDs
+func (store *Store) nameTakenUnlocked(id [8]byte, name string) bool {
+	for _, m := range store.members {
+		if m.ID != id && (strings.EqualFold(m.Name, name) || strings.EqualFold(m.Requested, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestName files a request for the display name, which replaces the previous pending one
+func (store *Store) RequestName(id [8]byte, name string) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	if store.nameTakenUnlocked(id, name) {
+		return fmt.Errorf("name already taken")
+	}
+
+	at := uint32(time.Now().Unix())
+
+	var p buffer
+	if err := store.appendPrivate(p.WriteByte(OP_NAMEREQ).Write8Bytes(id).WriteString(name).WriteUInt32(at).Bytes()); err != nil {
+		return err
+	}
+
+	m := store.members[id]
+	if m == nil {
+		m = &Member{ID: id}
+		store.members[id] = m
+	}
+	m.Requested, m.RequestedAt = name, at
+	return nil
+}
+
+// ApproveName approves the pending name of id
+func (store *Store) ApproveName(id, approver [8]byte) error {
+	store.Lock()
+	defer store.Unlock()
+
+	m := store.members[id]
+	if m == nil || m.Requested == "" {
+		return fmt.Errorf("no pending name")
+	}
+
+	at := uint32(time.Now().Unix())
+
+	var p buffer
+	if err := store.appendPrivate(p.WriteByte(OP_NAMEOK).Write8Bytes(id).Write8Bytes(approver).WriteUInt32(at).Bytes()); err != nil {
+		return err
+	}
+
+	m.Name, m.ApprovedAt, m.Approver, m.Requested = m.Requested, at, approver, ""
+	return nil
+}
+
+// DeleteName rejects the pending name of id, or removes the approved one if approved is true
+func (store *Store) DeleteName(id [8]byte, approved bool) error {
+	store.Lock()
+	defer store.Unlock()
+
+	m := store.members[id]
+	if m == nil {
+		return fmt.Errorf("no such member")
+	}
+
+	which := byte(nameRequest)
+	if approved {
+		which = nameApproved
+	}
+
+	var p buffer
+	if err := store.appendPrivate(p.WriteByte(OP_NAMEDEL).Write8Bytes(id).WriteByte(which).Bytes()); err != nil {
+		return err
+	}
+
+	m.deleteName(which)
+	return nil
+}
+
+// DisplayName returns the approved name of id
+func (store *Store) DisplayName(id [8]byte) string {
+	store.RLock()
+	defer store.RUnlock()
+	if m := store.members[id]; m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+// GetMember returns the registry entry of id
+func (store *Store) GetMember(id [8]byte) Member {
+	store.RLock()
+	defer store.RUnlock()
+	if m := store.members[id]; m != nil {
+		return *m
+	}
+	return Member{ID: id}
+}
+
+// GetMembers returns members with approved names if pending is false, otherwise members with pending names,
+// sorted by the approval (or request) time
+func (store *Store) GetMembers(pending bool) []Member {
+	store.RLock()
+	defer store.RUnlock()
+
+	res := []Member{}
+	for _, m := range store.members {
+		if (!pending && m.Name != "") || (pending && m.Requested != "") {
+			res = append(res, *m)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if pending {
+			return res[i].RequestedAt < res[j].RequestedAt
+		}
+		return res[i].ApprovedAt < res[j].ApprovedAt
+	})
+	return res
+}
+
+// maxInboxSize is the number of the latest replies kept in each inbox
+const maxInboxSize = 200
+
+// indexReferencesUnlocked adds the post into the inboxes of the authors it quotes, the index is rebuilt when loading
+func (store *Store) indexReferencesUnlocked(p *Post, topicByID func(uint32) *Topic) {
+	if store.inbox == nil {
+		// dummy stores of archived topics
+		return
+	}
+
+	me := p.UserXor()
+	for _, ref := range markup.References(p.Message) {
+		topicID, postID := SplitID(ref)
+		t := topicByID(topicID)
+		if t == nil || postID == 0 || int(postID) > len(t.Posts) {
+			continue
+		}
+
+		author := t.Posts[postID-1].UserXor()
+		if author == me || author == default8Bytes {
+			continue
+		}
+
+		entries := append(store.inbox[author], InboxEntry{LongID: p.LongID(), CreatedAt: p.CreatedAt})
+		if len(entries) > maxInboxSize {
+			entries = entries[len(entries)-maxInboxSize:]
+		}
+		store.inbox[author] = entries
+	}
+}
+
+// GetInbox returns visible posts quoting the posts of id, newest first
+func (store *Store) GetInbox(id [8]byte) []Post {
+	store.RLock()
+	defer store.RUnlock()
+
+	entries := store.inbox[id]
+	res := make([]Post, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		p, err := store.getPostPtrUnlocked(entries[i].LongID)
+		if err != nil || p.IsDeleted() || p.IsPending() {
+			continue
+		}
+		res = append(res, *p)
+	}
+	return res
+}
+
+// CountInbox returns the number of visible replies to id since the timestamp, the same ones GetInbox returns
+func (store *Store) CountInbox(id [8]byte, since uint32) (n int) {
+	store.RLock()
+	defer store.RUnlock()
+	for _, e := range store.inbox[id] {
+		if e.CreatedAt <= since {
+			continue
+		}
+		if p, err := store.getPostPtrUnlocked(e.LongID); err == nil && !p.IsDeleted() && !p.IsPending() {
+			n++
+		}
+	}
+	return
+}
+
+// maxWatchedTopics is the number of topics one can watch at most
+const maxWatchedTopics = 200
+
+type watchKey struct {
+	ID    [8]byte
+	Topic uint32
+}
+
+func (store *Store) setWatchUnlocked(id [8]byte, topicID uint32, seen uint16) {
+	if store.watches[id] == nil {
+		store.watches[id] = make(map[uint32]uint16)
+	}
+	store.watches[id][topicID] = seen
+	delete(store.seenDirty, watchKey{id, topicID})
+}
+
+// WatchTopic adds the topic into the watch list of id, or removes it if watch is false
+func (store *Store) WatchTopic(id [8]byte, topicID uint32, watch bool) error {
+	store.Lock()
+	defer store.Unlock()
+
+	t := store.topicByIDUnlocked(topicID)
+	if t == nil {
+		return ErrInvalidTopic
+	}
+
+	var p buffer
+	if !watch {
+		if _, ok := store.watches[id][topicID]; !ok {
+			return nil
+		}
+		if err := store.appendPrivate(p.WriteByte(OP_UNWATCH).Write8Bytes(id).WriteUInt32(topicID).Bytes()); err != nil {
+			return err
+		}
+		delete(store.watches[id], topicID)
+		delete(store.seenDirty, watchKey{id, topicID})
+		return nil
+	}
+
+	if _, ok := store.watches[id][topicID]; !ok && len(store.watches[id]) >= maxWatchedTopics {
+		return fmt.Errorf("too many watched topics")
+	}
+
+	seen := uint16(len(t.Posts))
+	if err := store.appendPrivate(p.WriteByte(OP_WATCH).Write8Bytes(id).WriteUInt32(topicID).WriteUInt16(seen).Bytes()); err != nil {
+		return err
+	}
+	store.setWatchUnlocked(id, topicID, seen)
+	return nil
+}
+
+// IsWatching tells whether id is watching the topic
+func (store *Store) IsWatching(id [8]byte, topicID uint32) bool {
+	store.RLock()
+	defer store.RUnlock()
+	_, ok := store.watches[id][topicID]
+	return ok
+}
+
+// MarkTopicSeen updates the seen counter if id is watching the topic and there are new posts,
+// it is called on every topic view, so the counter is only written by FlushWatches later
+func (store *Store) MarkTopicSeen(id [8]byte, topicID uint32) {
+	// most views are from IDs not watching the topic, don't block readers for them
+	store.RLock()
+	_, ok := store.unseenPostsUnlocked(id, topicID)
+	store.RUnlock()
+	if !ok {
+		return
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if n, ok := store.unseenPostsUnlocked(id, topicID); ok {
+		store.watches[id][topicID] = uint16(n)
+		store.seenDirty[watchKey{id, topicID}] = true
+	}
+}
+
+// unseenPostsUnlocked returns the number of posts in the topic and true if id is watching it and there are new posts
+func (store *Store) unseenPostsUnlocked(id [8]byte, topicID uint32) (int, bool) {
+	seen, ok := store.watches[id][topicID]
+	t := store.topicByIDUnlocked(topicID)
+	if !ok || t == nil || int(seen) >= len(t.Posts) {
+		return 0, false
+	}
+	return len(t.Posts), true
+}
+
+// FlushWatches writes the seen counters updated by MarkTopicSeen into the private log
+func (store *Store) FlushWatches() error {
+	store.Lock()
+	defer store.Unlock()
+
+	var p buffer
+	for k := range store.seenDirty {
+		if seen, ok := store.watches[k.ID][k.Topic]; ok {
+			if err := store.appendPrivate(p.Reset().WriteByte(OP_WATCH).Write8Bytes(k.ID).WriteUInt32(k.Topic).WriteUInt16(seen).Bytes()); err != nil {
+				return err
+			}
+		}
+		delete(store.seenDirty, k)
+	}
+	return nil
+}
+
+// GetWatchedTopics returns the live topics watched by id, sorted by the last activity
+func (store *Store) GetWatchedTopics(id [8]byte) []WatchedTopic {
+	store.RLock()
+	defer store.RUnlock()
+
+	res := []WatchedTopic{}
+	for topicID, seen := range store.watches[id] {
+		t := store.topicByIDUnlocked(topicID)
+		if t == nil {
+			continue
+		}
+		wt := WatchedTopic{ID: t.ID, Subject: t.Subject, ModifiedAt: t.ModifiedAt}
+		if wt.ModifiedAt == 0 {
+			wt.ModifiedAt = t.CreatedAt
+		}
+		for i := int(seen); i < len(t.Posts); i++ {
+			// held posts are only visible to their authors
+			if p := &t.Posts[i]; !p.IsDeleted() && (!p.IsPending() || p.UserXor() == id) {
+				wt.New++
+			}
+		}
+		res = append(res, wt)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ModifiedAt > res[j].ModifiedAt })
+	return res
+}
+
+// GetModActions returns audit log entries accepted by filter (or all entries if filter is nil), newest first,
+// the second return value is the total number of matched entries
+func (store *Store) GetModActions(start, n int, filter func(*ModAction) bool) ([]ModAction, int) {
+	store.RLock()
+	defer store.RUnlock()
+
+	res, total := make([]ModAction, 0, n), 0
+	for i := len(store.modActions) - 1; i >= 0; i-- {
+		a := &store.modActions[i]
+		if filter != nil && !filter(a) {
+			continue
+		}
+		if total >= start && len(res) < n {
+			res = append(res, *a)
+		}
+		total++
+	}
+	return res, total
+}
+
+// GetReportedPosts returns reported posts, the most reported come first
+func (store *Store) GetReportedPosts() []ReportedPost {
+	store.RLock()
+	defer store.RUnlock()
+
+	res := make([]ReportedPost, 0, len(store.reports))
+	for longID, reports := range store.reports {
+		post, err := store.getPostPtrUnlocked(longID)
+		if err != nil {
+			continue
+		}
+		res = append(res, ReportedPost{Post: *post, Reports: reports})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if len(res[i].Reports) == len(res[j].Reports) {
+			return res[i].Reports[0].CreatedAt < res[j].Reports[0].CreatedAt
+		}
+		return len(res[i].Reports) > len(res[j].Reports)
+	})
+	return res
+}
+
 func (store *Store) FlagPost(u User, postLongID uint64, flag byte, callback func(p *Post)) error {
 	store.Lock()
 	defer store.Unlock()
@@ -68,7 +881,7 @@ func (store *Store) FlagPost(u User, postLongID uint64, flag byte, callback func
 		return err
 	}
 
-	if !u.Can(PERM_LOCK_SAGE_DELETE_FLAG) && u.ID != post.UserXor() {
+	if !u.Can(CAP_FLAG) && u.ID != post.UserXor() {
 		return fmt.Errorf("can't flag the post")
 	}
 
@@ -78,23 +891,39 @@ func (store *Store) FlagPost(u User, postLongID uint64, flag byte, callback func
 	}
 
 	callback(post)
+	store.publishUpdate(post.Topic.ID, postLongID, flag)
 	return nil
 }
 
 func SnapshotStore(output string, store *Store) {
+	store.RLock()
+	defer store.RUnlock()
+	snapshotStoreUnlocked(output, store)
+}
+
+func snapshotStoreUnlocked(output string, store *Store) {
 	os.Remove(output)
 	dst, err := os.Create(output)
 	panicif(err != nil, "%v", err)
 	defer dst.Close()
 
-	store.RLock()
-	defer store.RUnlock()
-
 	write := func(buf []byte) {
 		_, err := dst.Write(buf)
 		panicif(err != nil, "%v", err)
 	}
 
+	// records of the private log go next to the snapshot
+	os.Remove(output + ".private")
+	pdst, err := os.OpenFile(output+".private", os.O_RDWR|os.O_CREATE, 0600)
+	panicif(err != nil, "%v", err)
+	defer pdst.Close()
+
+	writePrivate := func(buf []byte) {
+		var p buffer
+		_, err := pdst.Write(append(p.WriteUInt32(uint32(len(buf))).Bytes(), buf...))
+		panicif(err != nil, "%v", err)
+	}
+
 	// header
 	write([]byte{'z', 'z', 'z', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 
@@ -123,11 +952,83 @@ func SnapshotStore(output string, store *Store) {
 	var p buffer
 	write(p.WriteByte(OP_TOPICNUM).WriteUInt32(store.topicsCount).Bytes())
 
-	for k := range store.blocked {
-		write(p.Reset().WriteByte(OP_BLOCK).Write8Bytes(k).Bytes())
+	for _, b := range store.blocked {
+		if !b.IsExpired() {
+			writePrivate(b.marshal(p.Reset()).Bytes())
+		}
+	}
+
+	for _, b := range store.blockedRanges {
+		if !b.IsExpired() {
+			writePrivate(b.marshal(p.Reset()).Bytes())
+		}
+	}
+
+	for longID, reports := range store.reports {
+		post, err := store.getPostPtrUnlocked(longID)
+		if err != nil {
+			continue
+		}
+		for _, r := range reports {
+			writePrivate(p.Reset().WriteByte(OP_REPORT).
+				WriteUInt32(post.Topic.ID).
+				WriteUInt16(post.ID).
+				Write8Bytes(r.Reporter).
+				WriteUInt32(r.CreatedAt).
+				WriteString(r.Reason).Bytes())
+		}
+	}
+
+	for _, a := range store.modActions {
+		writePrivate(a.marshal(p.Reset()).Bytes())
+	}
+
+	for _, s := range store.sessions {
+		writePrivate(s.marshal(p.Reset()).Bytes())
+	}
+
+	for _, inv := range store.invites {
+		writePrivate(inv.marshal(p.Reset()).Bytes())
+		for _, u := range inv.Uses {
+			writePrivate(u.marshal(p.Reset(), inv.ID).Bytes())
+		}
+	}
+
+	for _, t := range store.tokens {
+		writePrivate(t.marshal(p.Reset()).Bytes())
+		if t.Revoked {
+			writePrivate(p.Reset().WriteByte(OP_UNTOKEN).Write8Bytes(t.ID).Bytes())
+		}
+	}
+
+	for _, m := range store.members {
+		if m.Name != "" {
+			writePrivate(p.Reset().WriteByte(OP_NAMEREQ).Write8Bytes(m.ID).WriteString(m.Name).WriteUInt32(m.ApprovedAt).Bytes())
+			writePrivate(p.Reset().WriteByte(OP_NAMEOK).Write8Bytes(m.ID).Write8Bytes(m.Approver).WriteUInt32(m.ApprovedAt).Bytes())
+		}
+		if m.Requested != "" {
+			writePrivate(p.Reset().WriteByte(OP_NAMEREQ).Write8Bytes(m.ID).WriteString(m.Requested).WriteUInt32(m.RequestedAt).Bytes())
+		}
+	}
+
+	for id, topics := range store.watches {
+		for topicID, seen := range topics {
+			if store.topicByIDUnlocked(topicID) != nil {
+				writePrivate(p.Reset().WriteByte(OP_WATCH).Write8Bytes(id).WriteUInt32(topicID).WriteUInt16(seen).Bytes())
+			}
+		}
+	}
+
+	for _, rs := range store.revoked {
+		for _, r := range rs {
+			writePrivate(r.marshal(p.Reset()).Bytes())
+		}
 	}
 
 	write(p.Reset().WriteByte(OP_CONFIG).WriteString(store.configStr).Bytes())
+	if store.filterStr != "" {
+		writePrivate(p.Reset().WriteByte(OP_FILTER).WriteString(store.filterStr).Bytes())
+	}
 	write(p.Reset().WriteByte(OP_MAXTOPICS).WriteUInt32(uint32(store.maxLiveTopics)).Bytes())
 
 	n, err := dst.Seek(0, 1)
@@ -163,10 +1064,29 @@ func (store *Store) SetMaxLiveTopics(num int) error {
 func (store *Store) GetConfig(v interface{}) error {
 	store.configLock.RLock()
 	defer store.configLock.RUnlock()
+	return store.getConfigUnlocked(v)
+}
+
+func (store *Store) getConfigUnlocked(v interface{}) error {
 	if store.configStr == "" {
 		return nil
 	}
-	return json.Unmarshal([]byte(store.configStr), v)
+	if err := json.Unmarshal([]byte(store.configStr), v); err != nil {
+		return err
+	}
+
+	// filters are not a part of the public config, so spammers can't read them from /data.bin
+	if c, ok := v.(*ForumConfig); ok {
+		if store.filterStr == "" {
+			// old stores have them in the public config
+			var old struct{ Filter FilterConfig }
+			json.Unmarshal([]byte(store.configStr), &old)
+			c.Filter = old.Filter
+			return nil
+		}
+		return json.Unmarshal([]byte(store.filterStr), &c.Filter)
+	}
+	return nil
 }
 
 func (store *Store) UpdateConfig(v interface{}) error {
@@ -176,10 +1096,96 @@ func (store *Store) UpdateConfig(v interface{}) error {
 	buf, _ := json.Marshal(v)
 
 	var p buffer
-	if err := store.append(p.WriteByte(OP_CONFIG).WriteString(string(buf)).Bytes()); err != nil {
-		json.Unmarshal([]byte(store.configStr), v)
+	if c, ok := v.(*ForumConfig); ok {
+		if filter, _ := json.Marshal(c.Filter); string(filter) != store.filterStr {
+			store.Lock()
+			err := store.appendPrivate(p.WriteByte(OP_FILTER).WriteString(string(filter)).Bytes())
+			store.Unlock()
+			if err != nil {
+				store.getConfigUnlocked(v)
+				return err
+			}
+			store.filterStr = string(filter)
+		}
+	}
+
+	if err := store.append(p.Reset().WriteByte(OP_CONFIG).WriteString(string(buf)).Bytes()); err != nil {
+		store.getConfigUnlocked(v)
 		return err
 	}
 	store.configStr = string(buf)
 	return nil
 }
+
+func (t *Topic) rekey(from, to cipher.Block) {
+	for i := range t.Posts {
+		p := &t.Posts[i]
+		p.ip = p.xorKey(to, p.xorKey(from, p.ip))
+		p.user = p.xorKey(to, p.xorKey(from, p.user))
+	}
+}
+
+// Rekey re-encrypts IPs and users of all posts, including archived ones, with the new key.
+// Everything is written into temporary files first, then moved into place, the old main store will be kept
+// as a backup. The store must not be used afterwards.
+func (store *Store) Rekey(newKey [16]byte) error {
+	store.Lock()
+	defer store.Unlock()
+
+	to, err := aes.NewCipher(newKey[:])
+	if err != nil {
+		return err
+	}
+
+	// path => temporary path
+	files := map[string]string{}
+	defer func() {
+		for _, tmp := range files {
+			os.Remove(tmp)
+		}
+	}()
+
+	archiveDir := filepath.Join(filepath.Dir(store.dataFilePath), "archive")
+	if err := filepath.Walk(archiveDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".rekey") {
+			return err
+		}
+		t, err := loadArchive(path, store.block)
+		if err != nil {
+			return err
+		}
+		t.rekey(store.block, to)
+		if err := archive(t, path+".rekey"); err != nil {
+			return err
+		}
+		files[path] = path + ".rekey"
+		return nil
+	}); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for topic := store.rootTopic.Next; topic != store.endTopic; topic = topic.Next {
+		topic.rekey(store.block, to)
+	}
+	store.block = to
+
+	snapshotStoreUnlocked(store.dataFilePath+".rekey", store)
+
+	backup := fmt.Sprintf("%s.%d.bak", store.dataFilePath, time.Now().Unix())
+	if err := os.Rename(store.dataFilePath, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(store.privateFilePath(), backup+".private"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	files[store.dataFilePath] = store.dataFilePath + ".rekey"
+	files[store.privateFilePath()] = store.dataFilePath + ".rekey.private"
+
+	for path, tmp := range files {
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+		delete(files, path)
+	}
+	return nil
+}
@@ -2,10 +2,18 @@ package server
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"fmt"
+	"html"
 	"net/http"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/coyove/fofou/markup"
 )
@@ -14,6 +22,7 @@ const (
 	POST_ISDELETE = 1 << iota // used in archive only, normal deletion will have OP_DELETE
 	POST_SHOWID
 	POST_ISSAGE
+	POST_ISPENDING // held for review, OP_APPROVE will clear it
 )
 
 const (
@@ -35,6 +44,7 @@ type Image struct {
 type Post struct {
 	Message   string
 	Image     *Image
+	Trip      *Tripcode
 	user      [8]byte
 	ip        [8]byte
 	CreatedAt uint32
@@ -50,6 +60,8 @@ func (p *Post) SetStatus(v byte) { p.Status |= v }
 
 func (p *Post) T_UnsetStatus(v byte) { p.T_Status &= ^v }
 
+func (p *Post) UnsetStatus(v byte) { p.Status &= ^v }
+
 func (p *Post) T_InvertStatus(v byte) { p.T_Status ^= v }
 
 func (p *Post) InvertStatus(v byte) { p.Status ^= v }
@@ -68,19 +80,23 @@ func (p *Post) IsDeleted() bool { return p.Status&POST_ISDELETE > 0 }
 
 func (p *Post) IsSaged() bool { return p.Status&POST_ISSAGE > 0 }
 
+func (p *Post) IsPending() bool { return p.Status&POST_ISPENDING > 0 }
+
 func (p *Post) Date() string {
 	return time.Unix(int64(p.CreatedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
 }
 
 func (p *Post) MessageHTML() string { return markup.Do(p.Message, true, 0) }
 
-func (p *Post) aes128(a [8]byte) [8]byte {
+func (p *Post) aes128(a [8]byte) [8]byte { return p.xorKey(p.Topic.store.block, a) }
+
+func (p *Post) xorKey(block cipher.Block, a [8]byte) [8]byte {
 	iv := [16]byte{}
 	binary.BigEndian.PutUint32(iv[:], p.Topic.CreatedAt)
 	binary.BigEndian.PutUint32(iv[4:], p.Topic.ID)
 	copy(iv[8:], p.Topic.Subject)
 
-	p.Topic.store.block.Encrypt(iv[:], iv[:])
+	block.Encrypt(iv[:], iv[:])
 	// the first 2 bytes of 'a' will never be encrypted
 	for i := 2; i < 8; i++ {
 		a[i] ^= iv[i]
@@ -98,11 +114,22 @@ func (p *Post) User() string { _, i := Format8Bytes(p.UserXor()); return i }
 
 func (p *Post) UserHTML() string {
 	if p.user[0] == 0 {
+		if name := p.Topic.store.DisplayName(p.UserXor()); name != "" {
+			return "<a href='/members' class='special-user'>@" + html.EscapeString(name) + "</a>"
+		}
 		return ""
 	}
 	return "<span class='special-user'>" + p.User()[1:] + "</span>"
 }
 
+// PublicName returns the special ID or the approved name of the author, the anonymous ID itself is never exposed
+func (p *Post) PublicName() string {
+	if p.user[0] == 0 {
+		return p.Topic.store.DisplayName(p.UserXor())
+	}
+	return p.User()[1:]
+}
+
 func (p *Post) LongID() uint64 {
 	if p.ID >= 1<<12 || p.ID == 0 {
 		panic("invalid post ID")
@@ -139,6 +166,381 @@ func SplitID(longid uint64) (uint32, uint16) {
 	return uint32(longid >> 14), uint16(longid>>10&0xf)<<8 + uint16(longid>>5&0xf)<<4 + uint16(longid&0xf) + 1
 }
 
+// Ban describes a block on an IP address or a user ID
+type Ban struct {
+	Term      [8]byte
+	Mod       [8]byte
+	CreatedAt uint32
+	Until     uint32 // 0 means forever
+	Reason    string
+	Bits      byte // prefix length of Term if it is an IP range, otherwise 0
+}
+
+func (b Ban) IsExpired() bool { return b.Until > 0 && uint32(time.Now().Unix()) >= b.Until }
+
+func (b Ban) Date() string {
+	return time.Unix(int64(b.CreatedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+func (b Ban) UntilDate() string {
+	if b.Until == 0 {
+		return "永久"
+	}
+	return time.Unix(int64(b.Until), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+func (b Ban) ModName() string {
+	if b.Mod == default8Bytes {
+		return "system"
+	}
+	_, m := Format8Bytes(b.Mod)
+	return m
+}
+
+func (b Ban) TermString() string {
+	if b.Bits > 0 {
+		return FormatIPRange(b.Term, int(b.Bits))
+	}
+	ip, id := Format8Bytes(b.Term)
+	if isIPv4(b.Term) || b.Term[0] != 0 || b.Term[1] != 0 {
+		return ip
+	}
+	return id
+}
+
+func (b Ban) marshal(p *buffer) *buffer {
+	if b.Bits > 0 {
+		p.WriteByte(OP_RANGE).WriteByte(b.Bits)
+	} else {
+		p.WriteByte(OP_BAN)
+	}
+	return p.Write8Bytes(b.Term).
+		Write8Bytes(b.Mod).
+		WriteUInt32(b.CreatedAt).
+		WriteUInt32(b.Until).
+		WriteString(b.Reason)
+}
+
+// Report is a complaint filed by a user against a post
+type Report struct {
+	Reporter  [8]byte
+	CreatedAt uint32
+	Reason    string
+}
+
+func (r Report) ReporterName() string { _, n := Format8Bytes(r.Reporter); return n }
+
+func (r Report) Date() string {
+	return time.Unix(int64(r.CreatedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+// ReportedPost groups all unresolved reports against a post
+type ReportedPost struct {
+	Post
+	Reports []Report
+}
+
+// ModAction is an entry of the moderation audit log
+type ModAction struct {
+	CreatedAt uint32
+	Actor     [8]byte
+	Action    string
+	Target    string
+	Reason    string
+}
+
+func (a ModAction) ActorName() string { _, n := Format8Bytes(a.Actor); return n }
+
+func (a ModAction) Date() string {
+	return time.Unix(int64(a.CreatedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+func (a ModAction) marshal(p *buffer) *buffer {
+	return p.WriteByte(OP_MODLOG).
+		WriteUInt32(a.CreatedAt).
+		Write8Bytes(a.Actor).
+		WriteString(a.Action).
+		WriteString(a.Target).
+		WriteString(a.Reason)
+}
+
+// TripPrefix is put before the code when displaying a tripcode, it is also the prefix to search tripcodes in /list
+const TripPrefix = "◆"
+
+// Tripcode is an optional persistent identity, Code is derived from the secret and the salt
+type Tripcode struct {
+	Name string
+	Code string
+}
+
+// MakeTripcode parses "name#secret", it returns nil if no secret is given
+func MakeTripcode(str string, salt [16]byte) *Tripcode {
+	idx := strings.Index(str, "#")
+	if idx == -1 || idx == len(str)-1 {
+		return nil
+	}
+
+	name := []rune(strings.TrimSpace(str[:idx]))
+	if len(name) > 16 {
+		name = name[:16]
+	}
+
+	mac := hmac.New(sha256.New, salt[:])
+	mac.Write([]byte(str[idx+1:]))
+	return &Tripcode{Name: string(name), Code: base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:6])}
+}
+
+func (t *Tripcode) String() string { return t.Name + TripPrefix + t.Code }
+
+func (t *Tripcode) marshal(p *buffer, topicID uint32, postID uint16) *buffer {
+	return p.WriteByte(OP_TRIP).
+		WriteUInt32(topicID).
+		WriteUInt16(postID).
+		WriteString(t.Name).
+		WriteString(t.Code)
+}
+
+// Invite lets new visitors get an ID when NoMoreNewUsers is on,
+// only the hash of the code is stored because the log is public
+type Invite struct {
+	ID        [8]byte
+	Creator   [8]byte
+	CreatedAt uint32
+	MaxUses   uint16
+	Uses      []InviteUse
+}
+
+// InviteUse records who has been invited
+type InviteUse struct {
+	User      [8]byte
+	CreatedAt uint32
+}
+
+func (i Invite) CreatorName() string { _, n := Format8Bytes(i.Creator); return n }
+
+func (i Invite) Date() string {
+	return time.Unix(int64(i.CreatedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+func (i Invite) IDString() string { return fmt.Sprintf("%x", i.ID) }
+
+func (u InviteUse) UserName() string { _, n := Format8Bytes(u.User); return n }
+
+func (i Invite) marshal(p *buffer) *buffer {
+	return p.WriteByte(OP_INVITE).
+		Write8Bytes(i.ID).
+		Write8Bytes(i.Creator).
+		WriteUInt32(i.CreatedAt).
+		WriteUInt16(i.MaxUses)
+}
+
+func (u InviteUse) marshal(p *buffer, inviteID [8]byte) *buffer {
+	return p.WriteByte(OP_REDEEM).
+		Write8Bytes(inviteID).
+		Write8Bytes(u.User).
+		WriteUInt32(u.CreatedAt)
+}
+
+// NewInviteCode generates a random code, the ID of which is used to store the invite
+func NewInviteCode() (string, [8]byte) {
+	buf := make([]byte, 10)
+	rand.Read(buf)
+	code := base32Encoding.EncodeToString(buf)
+	return code, InviteID(code)
+}
+
+// InviteID hashes the code
+func InviteID(code string) (id [8]byte) {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	h := sha256.Sum256([]byte(code))
+	copy(id[:], h[:])
+	return
+}
+
+const (
+	TOKEN_TOPIC = 1 << iota // create new topics
+	TOKEN_REPLY             // reply to topics
+)
+
+var tokenScopes = []struct {
+	Name  string
+	Scope byte
+}{{"topic", TOKEN_TOPIC}, {"reply", TOKEN_REPLY}}
+
+// APIToken lets scripts post on behalf of User without a browser,
+// only the hash of the token is stored because the log is public
+type APIToken struct {
+	ID        [8]byte
+	User      [8]byte
+	Creator   [8]byte
+	CreatedAt uint32
+	Scopes    byte
+	RateLimit uint16 // posts per hour, 0 means unlimited
+	Revoked   bool
+}
+
+func (t APIToken) UserName() string { _, n := Format8Bytes(t.User); return n }
+
+func (t APIToken) CreatorName() string { _, n := Format8Bytes(t.Creator); return n }
+
+func (t APIToken) Date() string {
+	return time.Unix(int64(t.CreatedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+func (t APIToken) IDString() string { return fmt.Sprintf("%x", t.ID) }
+
+func (t APIToken) Can(scope byte) bool { return !t.Revoked && t.Scopes&scope == scope }
+
+// ScopeNames returns the scopes separated by commas
+func (t APIToken) ScopeNames() string {
+	names := []string{}
+	for _, s := range tokenScopes {
+		if t.Scopes&s.Scope > 0 {
+			names = append(names, s.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (t APIToken) marshal(p *buffer) *buffer {
+	return p.WriteByte(OP_TOKEN).
+		Write8Bytes(t.ID).
+		Write8Bytes(t.User).
+		Write8Bytes(t.Creator).
+		WriteUInt32(t.CreatedAt).
+		WriteByte(t.Scopes).
+		WriteUInt16(t.RateLimit)
+}
+
+// ParseTokenScopes parses scopes separated by commas, e.g.: "topic,reply"
+func ParseTokenScopes(v string) (byte, error) {
+	var scopes byte
+NEXT:
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		for _, s := range tokenScopes {
+			if s.Name == name {
+				scopes |= s.Scope
+				continue NEXT
+			}
+		}
+		return 0, fmt.Errorf("unknown scope: %q", name)
+	}
+	return scopes, nil
+}
+
+// NewAPIToken generates a random token, the ID of which is used to store the token
+func NewAPIToken() (string, [8]byte) {
+	buf := make([]byte, 20)
+	rand.Read(buf)
+	token := base32Encoding.EncodeToString(buf)
+	return token, InviteID(token)
+}
+
+// Member is an ID with a registered display name, a new name has to be approved by moderators
+type Member struct {
+	ID          [8]byte
+	Name        string // approved name
+	ApprovedAt  uint32
+	Approver    [8]byte
+	Requested   string // pending name
+	RequestedAt uint32
+}
+
+func (m Member) IDName() string { _, n := Format8Bytes(m.ID); return n }
+
+func (m Member) Date() string {
+	return time.Unix(int64(m.ApprovedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+func (m Member) RequestDate() string {
+	return time.Unix(int64(m.RequestedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+// ValidateName checks the display name, which can only contain letters, digits and underscores
+func ValidateName(name string) error {
+	if n := len([]rune(name)); n < 2 || n > 16 {
+		return fmt.Errorf("name should be within 2 ~ 16 characters")
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return fmt.Errorf("invalid character in name: %q", r)
+		}
+	}
+	return nil
+}
+
+// InboxEntry is a post which quotes one of the posts of the inbox owner
+type InboxEntry struct {
+	LongID    uint64
+	CreatedAt uint32
+}
+
+// WatchedTopic is a topic followed by the user, New is the number of posts since the last visit
+type WatchedTopic struct {
+	ID         uint32
+	Subject    string
+	ModifiedAt uint32
+	New        int
+}
+
+func (t WatchedTopic) Date() string {
+	return time.Unix(int64(t.ModifiedAt), 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+// Session is a privileged cookie issued by the admin, T is the same as User.T of the cookie
+type Session struct {
+	ID     [8]byte
+	T      int64
+	M      byte
+	R      byte
+	Issuer [8]byte
+
+	Revoked bool
+}
+
+func (s Session) IDName() string { _, n := Format8Bytes(s.ID); return n }
+
+func (s Session) IssuerName() string {
+	if s.Issuer == default8Bytes {
+		return "password"
+	}
+	_, n := Format8Bytes(s.Issuer)
+	return n
+}
+
+func (s Session) Date() string {
+	return time.Unix(s.T, 0).UTC().Add(8 * time.Hour).Format(stdTimeFormat)
+}
+
+func (s Session) marshal(p *buffer) *buffer {
+	return p.WriteByte(OP_SESSION).
+		Write8Bytes(s.ID).
+		WriteUInt32(uint32(s.T)).
+		WriteByte(s.M).
+		WriteByte(s.R).
+		Write8Bytes(s.Issuer)
+}
+
+// Revocation invalidates the cookie of ID created at T,
+// or all cookies of ID created before the revocation if T is 0
+type Revocation struct {
+	ID        [8]byte
+	T         int64
+	CreatedAt uint32
+}
+
+func (r Revocation) matches(t int64) bool {
+	return r.T == t || (r.T == 0 && t <= int64(r.CreatedAt))
+}
+
+func (r Revocation) marshal(p *buffer) *buffer {
+	return p.WriteByte(OP_REVOKE).
+		Write8Bytes(r.ID).
+		WriteUInt32(uint32(r.T)).
+		WriteUInt32(r.CreatedAt)
+}
+
 // Topic describes topic
 type Topic struct {
 	ID         uint32
@@ -181,6 +583,42 @@ func (t *Topic) Reparent(you [8]byte) {
 	}
 }
 
+// HidePending removes pending posts which are invisible to the current user, it should be called after Reparent
+func (t *Topic) HidePending(isAdmin bool) {
+	if isAdmin {
+		return
+	}
+	posts := t.Posts[:0]
+	for _, p := range t.Posts {
+		if !p.IsPending() || p.T_IsYou() {
+			posts = append(posts, p)
+		}
+	}
+	t.Posts = posts
+}
+
+// IsVisibleTo tells whether the topic can be seen by the user
+func (t *Topic) IsVisibleTo(you [8]byte, isAdmin bool) bool {
+	if isAdmin || len(t.Posts) == 0 || !t.Posts[0].IsPending() {
+		return true
+	}
+	return t.Posts[0].UserXor() == you
+}
+
+// FilterConfig configures filters applied to new posts,
+// the action of each filter is one of "reject", "hold" and "sage", empty means disabled
+type FilterConfig struct {
+	Words       []string // regular expressions
+	WordsAction string
+	MaxLinks    int // max links in a post from a new ID
+	NewIDPosts  int // IDs with fewer posts than this are considered new
+	LinksAction string
+	DupWindow   int // seconds to remember messages for duplicate detection
+	DupAction   string
+	MaxRefs     int // max '>>' references in a post
+	RefsAction  string
+}
+
 // ForumConfig is a static configuration of a single forum
 type ForumConfig struct {
 	Invalidate     int64
@@ -188,7 +626,9 @@ type ForumConfig struct {
 	NoMoreNewUsers bool
 	NoImageUpload  bool
 	NoRecaptcha    bool
+	NoOldCookies   bool // reject the old JSON cookies once the transition period ends
 	MaxImageSize   int
+	IPv6Prefix     int
 	MaxSubjectLen  int
 	MaxMessageLen  int
 	MinMessageLen  int
@@ -198,11 +638,16 @@ type ForumConfig struct {
 	TopicsPerPage  int
 	URL            string
 	Announcement   string
+	PremodHours    int // posts from IDs younger than this will be held for review
+	PremodPosts    int // posts from IDs with fewer posts than this will be held for review
+	Roles          []Role
 
 	// omit
-	Salt            [16]byte `json:"-"`
-	RecaptchaToken  string   `json:"-"`
-	RecaptchaSecret string   `json:"-"`
+	Filter          FilterConfig `json:"-"` // kept in the private log
+	Salt            [16]byte     `json:"-"`
+	OldSalts        [][16]byte   `json:"-"` // cookies signed by these salts are still accepted
+	RecaptchaToken  string       `json:"-"`
+	RecaptchaSecret string       `json:"-"`
 }
 
 func (config *ForumConfig) CorrectValues() {
@@ -215,14 +660,44 @@ func (config *ForumConfig) CorrectValues() {
 	checkInt(&config.Cooldown, 2)
 	checkInt(&config.PostsPerPage, 20)
 	checkInt(&config.TopicsPerPage, 15)
+	checkInt(&config.IPv6Prefix, 64)
+	if config.IPv6Prefix > 64 || config.IPv6Prefix < 16 {
+		config.IPv6Prefix = 64
+	}
+}
+
+// NeedsPremod tells whether posts from the user should be held for review
+func (config *ForumConfig) NeedsPremod(u User) bool {
+	if u.CanModerate() {
+		return false
+	}
+	if config.PremodHours > 0 && u.CreatedAt > 0 && time.Now().Unix()-u.CreatedAt < int64(config.PremodHours)*3600 {
+		return true
+	}
+	return config.PremodPosts > 0 && int(u.Posts) < config.PremodPosts
+}
+
+// GetRole returns the role with the given ID, or nil if there is no such role
+func (config *ForumConfig) GetRole(id byte) *Role {
+	for i := range config.Roles {
+		if config.Roles[i].ID == id {
+			return &config.Roles[i]
+		}
+	}
+	return nil
 }
 
 func (config *ForumConfig) SetSalt(v string) [16]byte {
-	v = strings.Repeat(v, 16) + "a-16chars-string"
-	copy(config.Salt[:], v)
+	config.Salt = MakeSalt(v)
 	return config.Salt
 }
 
+func MakeSalt(v string) (salt [16]byte) {
+	v = strings.Repeat(v, 16) + "a-16chars-string"
+	copy(salt[:], v)
+	return
+}
+
 // Forum describes forum
 type Forum struct {
 	*ForumConfig
@@ -232,6 +707,7 @@ type Forum struct {
 
 const userStructSize = 8 + 4 + 4 + 8 + 8
 
+// legacy permission bits stored in User.M, each of them acts as a built-in role
 const (
 	PERM_ADMIN = 1 << iota
 	PERM_NO_ROLL
@@ -241,48 +717,104 @@ const (
 	PERM_APPEND_ANNOUNCE
 )
 
-type User struct {
-	ID      [8]byte
-	N       uint32
-	Posts   uint32
-	T       int64
-	M       byte
-	padding [7]byte
-	Hash    string
-}
-
-func (u User) IsValid() bool { return u.ID != default8Bytes }
+const (
+	CAP_ADMIN    = "admin" // forum config, IDs and roles, implies all other capabilities
+	CAP_NO_ROLL  = "no-roll"
+	CAP_LOCK     = "lock"
+	CAP_SAGE     = "sage"
+	CAP_DELETE   = "delete"
+	CAP_FLAG     = "flag"
+	CAP_APPROVE  = "approve"
+	CAP_STICKY   = "sticky"
+	CAP_PURGE    = "purge"
+	CAP_BLOCK    = "block"
+	CAP_APPEND   = "append"
+	CAP_ANNOUNCE = "announce"
+	CAP_REPORTS  = "reports"
+	CAP_INVITE   = "invite"
+)
 
-func (u User) Can(perm byte) bool { return u.M&perm > 0 }
+var Capabilities = []string{CAP_ADMIN, CAP_NO_ROLL, CAP_LOCK, CAP_SAGE, CAP_DELETE, CAP_FLAG, CAP_APPROVE,
+	CAP_STICKY, CAP_PURGE, CAP_BLOCK, CAP_APPEND, CAP_ANNOUNCE, CAP_REPORTS, CAP_INVITE}
 
-func (u User) CanModerate() bool {
-	return u.Can(PERM_ADMIN) || u.Can(PERM_LOCK_SAGE_DELETE_FLAG) || u.Can(PERM_STICKY_PURGE) || u.Can(PERM_BLOCK) || u.Can(PERM_APPEND_ANNOUNCE)
+var legacyRoles = map[byte][]string{
+	PERM_ADMIN:                 {CAP_ADMIN},
+	PERM_NO_ROLL:               {CAP_NO_ROLL},
+	PERM_LOCK_SAGE_DELETE_FLAG: {CAP_LOCK, CAP_SAGE, CAP_DELETE, CAP_FLAG, CAP_APPROVE, CAP_REPORTS},
+	PERM_STICKY_PURGE:          {CAP_STICKY, CAP_PURGE, CAP_REPORTS},
+	PERM_BLOCK:                 {CAP_BLOCK, CAP_REPORTS},
+	PERM_APPEND_ANNOUNCE:       {CAP_APPEND, CAP_ANNOUNCE, CAP_REPORTS},
 }
 
-type SafeJSON struct {
-	*bytes.Buffer
+// Role is a named set of capabilities, users refer to it by ID in their cookies
+type Role struct {
+	ID   byte
+	Name string
+	Caps []string
 }
 
-func (s *SafeJSON) Write(p []byte) (int, error) {
-	for _, v := range p {
-		if v == ',' {
-			s.Buffer.WriteByte('^')
-			continue
+// Validate checks the role before it gets saved
+func (r Role) Validate() error {
+	if r.ID == 0 {
+		return fmt.Errorf("role ID can't be 0")
+	}
+	for _, c := range r.Caps {
+		if !hasCap(Capabilities, c) {
+			return fmt.Errorf("unknown capability: %s", c)
 		}
-		if v == '"' {
-			s.Buffer.WriteByte('\'')
-			continue
+	}
+	return nil
+}
+
+func hasCap(caps []string, c string) bool {
+	for _, x := range caps {
+		if x == c {
+			return true
 		}
-		if bytes.IndexByte([]byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ[]{}:"), v) > -1 {
-			s.Buffer.WriteByte(v)
-			continue
+	}
+	return false
+}
+
+type User struct {
+	ID        [8]byte
+	N         uint32
+	Posts     uint32
+	T         int64 // when the ID was created, or the last post before the upgrade for old IDs
+	M         byte
+	R         byte // role ID
+	padding   [6]byte
+	CreatedAt int64  `json:"-"` // when the ID was created, 0 for IDs from before tokens carried it
+	Hash      string // only used by legacy JSON cookies
+
+	roleCaps []string
+}
+
+func (u User) IsValid() bool { return u.ID != default8Bytes }
+
+func (u User) Can(c string) bool {
+	if hasCap(u.roleCaps, CAP_ADMIN) || hasCap(u.roleCaps, c) {
+		return true
+	}
+	for perm, caps := range legacyRoles {
+		if u.M&perm > 0 && (hasCap(caps, CAP_ADMIN) || hasCap(caps, c)) {
+			return true
 		}
-		if v == 0xa {
-			continue
+	}
+	return false
+}
+
+func (u User) CanModerate() bool {
+	for _, c := range Capabilities {
+		if c != CAP_NO_ROLL && u.Can(c) {
+			return true
 		}
-		panic(v)
 	}
-	return len(p), nil
+	return false
+}
+
+// SafeJSON reads legacy JSON cookies, in which commas and double quotes were substituted
+type SafeJSON struct {
+	*bytes.Buffer
 }
 
 func (s *SafeJSON) Read(p []byte) (int, error) {
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"path/filepath"
@@ -20,10 +21,16 @@ var (
 	TmplHelp    = "help.html"
 	TmplFooter  = "footer.html"
 	TmplBrowser = "imagesbrowser.html"
+	TmplModLog  = "modlog.html"
+
+	TmplTransparency = "transparency.html"
+	TmplMembers      = "members.html"
+	TmplInbox        = "inbox.html"
+	TmplWatched      = "watched.html"
 )
 
 var (
-	templateNames = []string{TmplForum, TmplTopic, TmplTopic1, TmplPosts, TmplNewPost, TmplLogs, TmplFooter, TmplHelp, TmplBrowser, "header.html", "post1.html"}
+	templateNames = []string{TmplForum, TmplTopic, TmplTopic1, TmplPosts, TmplNewPost, TmplLogs, TmplFooter, TmplHelp, TmplBrowser, TmplModLog, TmplTransparency, TmplMembers, TmplInbox, TmplWatched, "header.html", "post1.html"}
 	templatePaths []string
 	templates     *template.Template
 	tmplMutex     sync.RWMutex
@@ -42,6 +49,10 @@ func LoadTemplates(prod bool) {
 		"formatBytes": func(b uint64) string {
 			return fmt.Sprintf("%.2f MB", float64(b)/1024/1024)
 		},
+		"json": func(v interface{}) string {
+			buf, _ := json.Marshal(v)
+			return string(buf)
+		},
 	}
 	templates = template.Must(template.New("").Funcs(m).ParseFiles(templatePaths...))
 
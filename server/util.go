@@ -3,14 +3,17 @@ package server
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base32"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"regexp"
 	"sort"
@@ -50,7 +53,7 @@ func panicif(cond bool, args ...interface{}) {
 func Format8Bytes(b [8]byte) (string, string) {
 	buf, bufid := bytes.Buffer{}, bytes.Buffer{}
 
-	if b[0] == 0 && b[1] == 0 && b[2] == 0 && b[3] == 0 && b[7] == 0 {
+	if isIPv4(b) {
 		buf.WriteString(fmt.Sprintf("%d.%d.%d.", b[4], b[5], b[6]))
 	} else {
 		for i := 0; i < len(b); i += 2 {
@@ -91,12 +94,12 @@ func Parse8Bytes(str string) (b [8]byte) {
 	}
 	if strings.HasSuffix(str, ":x") {
 		parts := strings.Split(str, ":")
-		if len(parts) == 4 {
+		if len(parts) == 5 {
 			first := func(a uint64, e error) (byte, byte) { return byte(a >> 8), byte(a) }
-			b[0], b[1] = first(strconv.ParseUint(parts[0], 10, 64))
-			b[2], b[3] = first(strconv.ParseUint(parts[1], 10, 64))
-			b[4], b[5] = first(strconv.ParseUint(parts[2], 10, 64))
-			b[6], b[7] = first(strconv.ParseUint(parts[3], 10, 64))
+			b[0], b[1] = first(strconv.ParseUint(parts[0], 16, 64))
+			b[2], b[3] = first(strconv.ParseUint(parts[1], 16, 64))
+			b[4], b[5] = first(strconv.ParseUint(parts[2], 16, 64))
+			b[6], b[7] = first(strconv.ParseUint(parts[3], 16, 64))
 		}
 		return
 	}
@@ -108,31 +111,273 @@ func Parse8Bytes(str string) (b [8]byte) {
 	return
 }
 
-func (f *Forum) GetUser(r *http.Request) User {
-	uid, err := r.Cookie("uid")
+// EncodeIP stores the first 3 octets of an IPv4 address at b[4:7],
+// or the first v6bits (<= 64) bits of an IPv6 address
+func EncodeIP(ip net.IP, v6bits int) (b [8]byte) {
+	if len(ip) == 0 {
+		return
+	}
+	if ipv4 := ip.To4(); len(ipv4) > 0 {
+		copy(b[4:], ipv4[:3])
+		return
+	}
+	copy(b[:], ip.To16())
+	return maskIP(b, v6bits)
+}
+
+func maskIP(b [8]byte, bits int) [8]byte {
+	if bits < 64 {
+		v := binary.BigEndian.Uint64(b[:]) & ^(math.MaxUint64 >> uint(bits))
+		binary.BigEndian.PutUint64(b[:], v)
+	}
+	return b
+}
+
+func isIPv4(b [8]byte) bool { return b[0] == 0 && b[1] == 0 && b[2] == 0 && b[3] == 0 && b[7] == 0 }
+
+// ParseIPRange parses a CIDR into an encoded IP prefix and its length in bits,
+// IPv4 ranges narrower than /24 are widened to /24 because the last octet is never stored
+func ParseIPRange(str string) (b [8]byte, bits int, err error) {
+	ip, ipnet, err := net.ParseCIDR(str)
 	if err != nil {
-		return User{}
+		return
+	}
+	ones, _ := ipnet.Mask.Size()
+	if ip.To4() != nil {
+		if ones > 24 {
+			ones = 24
+		}
+		bits = 32 + ones
+	} else {
+		if ones > 64 {
+			ones = 64
+		}
+		bits = ones
 	}
+	b = maskIP(EncodeIP(ip, 64), bits)
+	return
+}
 
-	u := User{}
-	bufp := &SafeJSON{Buffer: bytes.NewBuffer([]byte(uid.Value))}
-	if err := json.NewDecoder(bufp).Decode(&u); err != nil {
-		return User{}
+// FormatIPRange is the reverse of ParseIPRange
+func FormatIPRange(b [8]byte, bits int) string {
+	if isIPv4(b) && bits >= 32 {
+		return fmt.Sprintf("%d.%d.%d.0/%d", b[4], b[5], b[6], bits-32)
 	}
+	ip := make(net.IP, 16)
+	copy(ip, b[:])
+	return fmt.Sprintf("%s/%d", ip, bits)
+}
 
+func matchIPRange(b [8]byte, bits int, ip [8]byte) bool {
+	if (bits >= 32 && isIPv4(b)) != isIPv4(ip) {
+		// IPv4 ranges only match IPv4 addresses and vice versa
+		return false
+	}
+	return maskIP(ip, bits) == b
+}
+
+// hashUser signs legacy JSON cookies, it hashes the raw memory of User so it depends on the struct layout
+func hashUser(u *User, salt [16]byte) string {
 	user := [userStructSize + 16]byte{}
-	copy(user[:], (*(*[userStructSize]byte)(unsafe.Pointer(&u)))[:])
-	copy(user[userStructSize:], f.Salt[:])
+	copy(user[:], (*(*[userStructSize]byte)(unsafe.Pointer(u)))[:])
+	copy(user[userStructSize:], salt[:])
 
 	x := sha256.Sum256(user[:])
 	for i := 0; i < 16; i++ {
 		x = sha256.Sum256(x[:])
 	}
+	return base32Encoding.EncodeToString(x[:30])
+}
+
+const (
+	userTokenVersion = 2
+	userTokenSize    = 1 + 8 + 4 + 4 + 8 + 1 + 1 + 8 // version, ID, N, Posts, T, M, R, CreatedAt
+	userTokenV1Size  = userTokenSize - 8             // version 1 has no CreatedAt
+	userTokenMACSize = 16
+)
+
+func signUserToken(payload []byte, salt [16]byte) []byte {
+	mac := hmac.New(sha256.New, salt[:])
+	mac.Write(payload)
+	return mac.Sum(nil)[:userTokenMACSize]
+}
+
+// encodeUserToken marshals the user into the cookie value: base64url(version|ID|N|Posts|T|M|R|CreatedAt|HMAC)
+func encodeUserToken(u *User, salt [16]byte) string {
+	buf := make([]byte, userTokenSize, userTokenSize+userTokenMACSize)
+	buf[0] = userTokenVersion
+	copy(buf[1:], u.ID[:])
+	binary.BigEndian.PutUint32(buf[9:], u.N)
+	binary.BigEndian.PutUint32(buf[13:], u.Posts)
+	binary.BigEndian.PutUint64(buf[17:], uint64(u.T))
+	buf[25], buf[26] = u.M, u.R
+	binary.BigEndian.PutUint64(buf[27:], uint64(u.CreatedAt))
+	return base64.RawURLEncoding.EncodeToString(append(buf, signUserToken(buf, salt)...))
+}
+
+func (f *Forum) decodeUserToken(tok string) (User, bool) {
+	buf, err := base64.RawURLEncoding.DecodeString(tok)
+	if err != nil || len(buf) == 0 {
+		return User{}, false
+	}
 
-	if base32Encoding.EncodeToString(x[:30]) != u.Hash {
+	size := userTokenSize
+	if buf[0] == 1 {
+		size = userTokenV1Size
+	} else if buf[0] != userTokenVersion {
+		return User{}, false
+	}
+	if len(buf) != size+userTokenMACSize {
+		return User{}, false
+	}
+
+	payload, sig := buf[:size], buf[size:]
+	valid := hmac.Equal(sig, signUserToken(payload, f.Salt))
+	for _, salt := range f.OldSalts {
+		if valid {
+			break
+		}
+		valid = hmac.Equal(sig, signUserToken(payload, salt))
+	}
+	if !valid {
+		return User{}, false
+	}
+
+	u := User{}
+	copy(u.ID[:], payload[1:9])
+	u.N = binary.BigEndian.Uint32(payload[9:])
+	u.Posts = binary.BigEndian.Uint32(payload[13:])
+	u.T = int64(binary.BigEndian.Uint64(payload[17:]))
+	u.M, u.R = payload[25], payload[26]
+	if size == userTokenSize {
+		u.CreatedAt = int64(binary.BigEndian.Uint64(payload[27:]))
+	}
+	return u, true
+}
+
+const (
+	recoveryCodeVersion = 2
+	recoveryCodeSize    = 1 + 8 + 1 + 4 + 2 // version, ID, N, T, Posts
+	recoveryCodeMACSize = 9
+	// version 1 has no Posts but a longer MAC, both make 25 bytes
+	recoveryCodeV1Size    = 1 + 8 + 1 + 4
+	recoveryCodeV1MACSize = 11
+)
+
+func signRecoveryCode(payload []byte, salt [16]byte) []byte {
+	mac := hmac.New(sha256.New, salt[:])
+	mac.Write([]byte("recovery"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// EncodeRecoveryCode exports the identity as a code of 8 groups of 5 letters, permissions are not included,
+// posts are capped at 65535 which is more than enough for PremodPosts
+func (f *Forum) EncodeRecoveryCode(u User) string {
+	posts := u.Posts
+	if posts > 0xffff {
+		posts = 0xffff
+	}
+
+	buf := make([]byte, recoveryCodeSize, recoveryCodeSize+recoveryCodeMACSize)
+	buf[0] = recoveryCodeVersion
+	copy(buf[1:], u.ID[:])
+	buf[9] = byte(u.N)
+	binary.BigEndian.PutUint32(buf[10:], uint32(u.T))
+	binary.BigEndian.PutUint16(buf[14:], uint16(posts))
+	code := base32Encoding.EncodeToString(append(buf, signRecoveryCode(buf, f.Salt)[:recoveryCodeMACSize]...))
+
+	groups := make([]string, 0, len(code)/5)
+	for i := 0; i < len(code); i += 5 {
+		groups = append(groups, code[i:i+5])
+	}
+	return strings.Join(groups, "-")
+}
+
+// DecodeRecoveryCode restores the identity exported by EncodeRecoveryCode
+func (f *Forum) DecodeRecoveryCode(code string) (User, bool) {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	buf, err := base32Encoding.DecodeString(code)
+	if err != nil || len(buf) != recoveryCodeSize+recoveryCodeMACSize {
+		return User{}, false
+	}
+
+	size := recoveryCodeSize
+	if buf[0] == 1 {
+		size = recoveryCodeV1Size
+	} else if buf[0] != recoveryCodeVersion {
+		return User{}, false
+	}
+
+	payload, sig := buf[:size], buf[size:]
+	valid := hmac.Equal(sig, signRecoveryCode(payload, f.Salt)[:len(sig)])
+	for _, salt := range f.OldSalts {
+		if valid {
+			break
+		}
+		valid = hmac.Equal(sig, signRecoveryCode(payload, salt)[:len(sig)])
+	}
+	if !valid {
+		return User{}, false
+	}
+
+	// T is when the ID was created, except for IDs upgraded from legacy cookies,
+	// where it is the last post before the upgrade, which is never younger
+	u := User{N: uint32(payload[9]), T: int64(binary.BigEndian.Uint32(payload[10:]))}
+	u.CreatedAt = u.T
+	copy(u.ID[:], payload[1:9])
+	if size == recoveryCodeSize {
+		u.Posts = uint32(binary.BigEndian.Uint16(payload[14:]))
+	}
+	return u, true
+}
+
+// decodeLegacyUser parses the old SafeJSON cookie, which will be replaced by the token when the user posts next time
+func (f *Forum) decodeLegacyUser(value string) (User, bool) {
+	u := User{}
+	bufp := &SafeJSON{Buffer: bytes.NewBuffer([]byte(value))}
+	if err := json.NewDecoder(bufp).Decode(&u); err != nil {
+		return User{}, false
+	}
+
+	if u.Hash == hashUser(&u, f.Salt) {
+		return u, true
+	}
+	for _, salt := range f.OldSalts {
+		if u.Hash == hashUser(&u, salt) {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+func (f *Forum) GetUser(r *http.Request) User {
+	uid, err := r.Cookie("uid")
+	if err != nil {
+		return User{}
+	}
+
+	var u User
+	var ok bool
+	if strings.HasPrefix(uid.Value, "{") {
+		if f.NoOldCookies {
+			return User{}
+		}
+		u, ok = f.decodeLegacyUser(uid.Value)
+	} else {
+		u, ok = f.decodeUserToken(uid.Value)
+	}
+	if !ok {
+		return User{}
+	}
+
+	if f.Store != nil && f.IsRevoked(u.ID, u.T) {
 		return User{}
 	}
 
+	if role := f.GetRole(u.R); u.R != 0 && role != nil {
+		u.roleCaps = role.Caps
+	}
 	return u
 }
 
@@ -149,24 +394,14 @@ func (u User) PassRoll() bool {
 
 func (f *Forum) SetUser(w http.ResponseWriter, u User) string {
 	u.Posts++
-	u.T = time.Now().Unix()
-
-	user := [userStructSize + 16]byte{}
-	copy(user[:], (*(*[userStructSize]byte)(unsafe.Pointer(&u)))[:])
-	copy(user[userStructSize:], f.Salt[:])
-
-	x := sha256.Sum256(user[:])
-	for i := 0; i < 16; i++ {
-		x = sha256.Sum256(x[:])
+	if u.T == 0 {
+		u.T = time.Now().Unix()
+		u.CreatedAt = u.T
 	}
-	u.Hash = base32Encoding.EncodeToString(x[:30])
-
-	bufp := &SafeJSON{Buffer: &bytes.Buffer{}}
-	json.NewEncoder(bufp).Encode(&u)
 
 	cookie := &http.Cookie{
 		Name:    "uid",
-		Value:   bufp.String(),
+		Value:   encodeUserToken(&u, f.Salt),
 		Path:    "/",
 		Expires: time.Now().AddDate(1, 0, 0),
 	}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventTopic  = "topic"
+	EventPost   = "post"
+	EventDelete = "delete"
+	EventMod    = "mod"
+)
+
+// WebhookEvents are the events a webhook can subscribe to
+var WebhookEvents = []string{EventTopic, EventPost, EventDelete, EventMod}
+
+const (
+	webhookMaxAttempts = 6
+	webhookRetryDelay  = 30 // seconds, doubled after each failed attempt
+)
+
+// Webhook is an endpoint notified of forum events, it is kept outside of main.txt because snapshots of main.txt are public
+type Webhook struct {
+	URL    string
+	Secret string   // payloads are signed by HMAC-SHA256 with this secret
+	Events []string // empty means all events
+}
+
+func (h *Webhook) Validate() error {
+	if !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+		return fmt.Errorf("invalid webhook URL: %q", h.URL)
+	}
+	for _, e := range h.Events {
+		if !h.knownEvent(e) {
+			return fmt.Errorf("unknown event: %q", e)
+		}
+	}
+	return nil
+}
+
+func (h *Webhook) knownEvent(e string) bool {
+	for _, x := range WebhookEvents {
+		if x == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body sent to the webhooks
+type WebhookPayload struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  int64       `json:"time"`
+	Forum string      `json:"forum"`
+	Data  interface{} `json:"data"`
+}
+
+// webhookDelivery is a pending delivery, saved as a file until it succeeds or runs out of attempts
+type webhookDelivery struct {
+	ID       string
+	URL      string
+	Event    string
+	Body     json.RawMessage
+	Attempts int
+	NextTry  int64
+}
+
+// SignWebhook returns the value of the X-Fofou-Signature header of the body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type WebhookQueue struct {
+	sync.Mutex
+	hooks      []Webhook
+	pending    map[string]*webhookDelivery
+	path       string
+	dir        string
+	wake       chan bool
+	client     *http.Client
+	Deliveries *CircularMessagesBuf
+	*Logger
+}
+
+// NewWebhookQueue loads the webhooks from path and the pending deliveries from dir, then starts the worker
+func NewWebhookQueue(l *Logger, path, dir string) *WebhookQueue {
+	q := &WebhookQueue{
+		pending:    map[string]*webhookDelivery{},
+		path:       path,
+		dir:        dir,
+		wake:       make(chan bool, 1),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		Deliveries: NewCircularMessagesBuf(256),
+		Logger:     l,
+	}
+
+	if buf, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(buf, &q.hooks); err != nil {
+			l.Error("webhooks: %v", err)
+		}
+	}
+
+	os.MkdirAll(dir, 0700)
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		d := &webhookDelivery{}
+		if err == nil {
+			err = json.Unmarshal(buf, d)
+		}
+		if err != nil || d.ID == "" {
+			l.Error("webhooks: bad delivery %s: %v", fi.Name(), err)
+			continue
+		}
+		// retry deliveries left by the last run right away
+		d.NextTry = 0
+		q.pending[d.ID] = d
+	}
+	if len(q.pending) > 0 {
+		l.Notice("webhooks: %d pending deliveries", len(q.pending))
+	}
+
+	go q.job()
+	q.notify()
+	return q
+}
+
+// Hooks returns a copy of the webhooks
+func (q *WebhookQueue) Hooks() []Webhook {
+	q.Lock()
+	defer q.Unlock()
+	return append([]Webhook{}, q.hooks...)
+}
+
+// SetHooks validates and saves the webhooks
+func (q *WebhookQueue) SetHooks(hooks []Webhook) error {
+	for i := range hooks {
+		if err := hooks[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	buf, _ := json.Marshal(hooks)
+	q.Lock()
+	defer q.Unlock()
+	if err := ioutil.WriteFile(q.path, buf, 0600); err != nil {
+		return err
+	}
+	q.hooks = hooks
+	return nil
+}
+
+// Len returns the number of pending deliveries
+func (q *WebhookQueue) Len() int {
+	if q == nil {
+		return 0
+	}
+	q.Lock()
+	defer q.Unlock()
+	return len(q.pending)
+}
+
+// Fire queues the event to all webhooks subscribing to it, q can be nil when running offline commands
+func (q *WebhookQueue) Fire(event, forumURL string, data interface{}) {
+	if q == nil {
+		return
+	}
+
+	q.Lock()
+	for _, h := range q.hooks {
+		if !h.wants(event) {
+			continue
+		}
+
+		id := make([]byte, 8)
+		rand.Read(id)
+		d := &webhookDelivery{ID: hex.EncodeToString(id), URL: h.URL, Event: event}
+		d.Body, _ = json.Marshal(WebhookPayload{
+			ID:    d.ID,
+			Event: event,
+			Time:  time.Now().Unix(),
+			Forum: forumURL,
+			Data:  data,
+		})
+		if err := q.saveUnlocked(d); err != nil {
+			q.Error("webhooks: save %s: %v", d.ID, err)
+		}
+		q.pending[d.ID] = d
+	}
+	q.Unlock()
+	q.notify()
+}
+
+func (q *WebhookQueue) notify() {
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+func (q *WebhookQueue) saveUnlocked(d *webhookDelivery) error {
+	buf, _ := json.Marshal(d)
+	return ioutil.WriteFile(filepath.Join(q.dir, d.ID+".json"), buf, 0600)
+}
+
+func (q *WebhookQueue) removeUnlocked(d *webhookDelivery) {
+	delete(q.pending, d.ID)
+	os.Remove(filepath.Join(q.dir, d.ID+".json"))
+}
+
+func (q *WebhookQueue) job() {
+	for {
+		select {
+		case <-q.wake:
+		case <-time.After(5 * time.Second):
+		}
+
+		now := time.Now().Unix()
+		due := []*webhookDelivery{}
+		q.Lock()
+		for _, d := range q.pending {
+			if d.NextTry <= now {
+				due = append(due, d)
+			}
+		}
+		q.Unlock()
+
+		sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+		for _, d := range due {
+			q.deliver(d)
+		}
+	}
+}
+
+func (q *WebhookQueue) deliver(d *webhookDelivery) {
+	var hook *Webhook
+	q.Lock()
+	for i := range q.hooks {
+		if q.hooks[i].URL == d.URL {
+			hook = &q.hooks[i]
+			break
+		}
+	}
+	if hook == nil {
+		// the webhook has been removed since
+		q.removeUnlocked(d)
+		q.Unlock()
+		return
+	}
+	secret := hook.Secret
+	q.Unlock()
+
+	req, _ := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fofou-webhook")
+	req.Header.Set("X-Fofou-Event", d.Event)
+	req.Header.Set("X-Fofou-Delivery", d.ID)
+	req.Header.Set("X-Fofou-Signature", SignWebhook(secret, d.Body))
+
+	status := ""
+	resp, err := q.client.Do(req)
+	if err != nil {
+		status = err.Error()
+	} else {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		status = resp.Status
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("%s", status)
+		}
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	d.Attempts++
+	q.Deliveries.Add(fmt.Sprintf("%s %s -> %s: %s (attempt %d)", d.ID, d.Event, d.URL, status, d.Attempts))
+
+	switch {
+	case err == nil:
+		q.removeUnlocked(d)
+	case d.Attempts >= webhookMaxAttempts:
+		q.Error("webhooks: give up %s to %s: %v", d.ID, d.URL, err)
+		q.removeUnlocked(d)
+	default:
+		d.NextTry = time.Now().Unix() + webhookRetryDelay<<uint(d.Attempts-1)
+		if err := q.saveUnlocked(d); err != nil {
+			q.Error("webhooks: save %s: %v", d.ID, err)
+		}
+	}
+}
+
+// GetDeliveries returns the recent delivery attempts, newest first
+func (q *WebhookQueue) GetDeliveries() []*TimestampedMsg {
+	q.Lock()
+	defer q.Unlock()
+	return q.Deliveries.GetOrdered()
+}
@@ -66,23 +66,55 @@ function _togglePost(id) {
     localStorage.setItem("fold", JSON.stringify(s));
 }
 
-function _submit(btn, msg, callback) {
+function _alertError(resp) {
+    var extra = resp.error != "banned" ? (resp.message ? "\n" + resp.message : "") :
+        "\n原因：" + (resp.reason || "无") +
+        "\n解封时间：" + (resp.until ? new Date(resp.until * 1000).toLocaleString() : "永久");
+    alert("发生错误：\ncode: " + resp.error + "\n" + ({
+        "bad-request": "无效请求 ",
+        "internal-error": "内部错误",
+        "recaptcha-needed": "请完成验证",
+        "recaptcha-failed": "验证失败，请刷新页面重试",
+        "no-more-new-users": "未持有cookie的匿名用户无法发言，持有邀请码请前往控制面板",
+        "message-too-short": "正文内容过短",
+        "topic-locked": "主题已被锁定",
+        "image-upload-failed": "图片上传失败",
+        "image-upload-disabled": "禁止上传图片",
+        "image-invalid-format": "图片格式不支持",
+        "image-disk-error": "图片上传失败",
+        "banned": "您已被封禁",
+        "filtered": "内容未通过过滤",
+        "permission-denied": "权限不足",
+        "unknown-op": "未知操作",
+        "invalid-value": "无效参数",
+        "operation-failed": "操作失败",
+        "invalid-code": "恢复码无效",
+        "invalid-name": "名称无效",
+    })[resp.error] + extra);
+}
+
+function _submit(btn, callback) {
+    var m = window.MOD_OP;
+    if (m) {
+        // the post form is borrowed by append, announce and report
+        return m.op == "report-post" ?
+            _mod(m.op, m.value, $('#message').val(), callback) :
+            _mod(m.op, m.value, "", callback, $('#message').val());
+    }
     btn ? $(btn).attr('disabled', 'true') : 0;
     var form = new FormData();
     var options = $('#options').val();
-    if (msg) {
-        form.append('message', msg);
-    } else {
-        form.append('subject', $('#subject').val());
-        form.append('message', $('#message').val());
-        form.append('image', $('#select-image').get(0).files[0]);
-        form.append('topic', window.TOPIC_ID || 0);
-        form.append('uuid', $('#newpost').attr('uuid'));
-        form.append('options', options);
-        try {
-            form.append('token', grecaptcha.getResponse());
-        } catch (ex) {}
-    }
+    var name = $('#name').val() || "";
+    form.append('subject', $('#subject').val());
+    form.append('message', $('#message').val());
+    form.append('image', $('#select-image').get(0).files[0]);
+    form.append('topic', window.TOPIC_ID || 0);
+    form.append('uuid', $('#newpost').attr('uuid'));
+    form.append('options', options);
+    form.append('name', name);
+    try {
+        form.append('token', grecaptcha.getResponse());
+    } catch (ex) {}
     var xhr = new XMLHttpRequest();
     xhr.onreadystatechange = function(e) {
         if ( 4 == this.readyState ) {
@@ -91,6 +123,8 @@ function _submit(btn, msg, callback) {
                 resp = JSON.parse(resp);
                 if (resp.success) {
                     localStorage.setItem("options", options ? options : "");
+                    localStorage.setItem("name", name);
+                    if (resp.pending) alert("您的发言需要审核后才会对其他人可见");
                     if (callback) {
                         callback();
                     } else {
@@ -99,19 +133,7 @@ function _submit(btn, msg, callback) {
                     }
                     return;
                 }
-                alert("发生错误：\ncode: " + resp.error + "\n" + ({
-                    "bad-request": "无效请求 ",
-                    "internal-error": "内部错误",
-                    "recaptcha-needed": "请完成验证",
-                    "recaptcha-failed": "验证失败，请刷新页面重试",
-                    "no-more-new-users": "未持有cookie的匿名用户无法发言",
-                    "message-too-short": "正文内容过短",
-                    "topic-locked": "主题已被锁定",
-                    "image-upload-failed": "图片上传失败",
-                    "image-upload-disabled": "禁止上传图片",
-                    "image-invalid-format": "图片格式不支持",
-                    "image-disk-error": "图片上传失败",
-                })[resp.error]);
+                _alertError(resp);
                 $("#newpost").attr("uuid", 'xxxxxxxxxxxx4xxxyxxxxxxxxxxxxxxx'.replace(/[xy]/g, function(c) {
                     var r = Math.random() * 16 | 0, v = c == 'x' ? r : (r & 0x3 | 0x8);
                     return v.toString(16);
@@ -127,6 +149,83 @@ function _submit(btn, msg, callback) {
     xhr.send(form);
 }
 
+function _mod(op, value, reason, callback, message) {
+    $.ajax({
+        type: "POST",
+        url: "/api/mod",
+        contentType: "application/json",
+        data: JSON.stringify({ op: op, value: String(value), reason: reason || "", message: message || "" }),
+        dataType: "json",
+        success: function(resp) {
+            if (!resp.success) return _alertError(resp);
+            callback ? callback(resp) : location.reload();
+        },
+        error: function(xhr) {
+            alert("发生错误：\n" + xhr.status + " " + xhr.statusText);
+        },
+    });
+}
+
+function _ban(term, callback) {
+    var hours = prompt("封禁时长（小时），留空为永久", "");
+    if (hours === null) return;
+    var reason = prompt("封禁原因", "") || "";
+    _mod("block", term + (parseInt(hours) > 0 ? "," + parseInt(hours) : ""), reason, callback);
+}
+
+function _modReason(op, value, callback) {
+    var reason = prompt("操作原因（可留空）", "");
+    if (reason === null) return;
+    _mod(op, value, reason, callback);
+}
+
+function _watch(topic, watch) {
+    $.post("/api/watch", { topic: topic, watch: watch ? 1 : 0 }, function(resp) {
+        if (!resp.success) return _alertError(resp);
+        location.reload();
+    }, "json");
+}
+
+// _live listens to new posts and moderation changes of the topic, or of all topics if topic is 0,
+// new replies are appended to the page if append is true, otherwise a notice is shown
+function _live(topic, append) {
+    if (!window.EventSource) return;
+    var es = new EventSource("/api/v1/events" + (topic ? "?topic=" + topic : "")), n = 0;
+    var notice = function() {
+        n++;
+        if (!$("#live-notice").length)
+            $("<div id=live-notice class=live-notice>").
+                append($("<a>").attr("href", "javascript:location.reload()")).
+                prependTo($(topic ? ".topic" : ".topics").first());
+        $("#live-notice a").text((topic ? "本主题有" : "有") + n + "条更新，点击刷新");
+    };
+    var on = function(type, fn) {
+        es.addEventListener(type, function(e) { fn(JSON.parse(e.data)); });
+    };
+
+    on("topic", notice);
+    on("update", notice); // including restored posts
+    on("post", function(ev) {
+        if (!append || $("#post-" + ev.longid).length) return notice();
+        $.get("/p/" + ev.longid + "?raw=1", function(data) {
+            var el = $("<div>").html(data).find(".post").first(), c = $(".topic .post-first");
+            if ($("#post-" + ev.longid).length) return;
+            (c.length ? c : $(".topic")).first().append(el);
+        }).fail(notice);
+    });
+    on("delete", function(ev) {
+        var el = $("#post-" + ev.longid);
+        if (!el.length) return topic ? null : notice();
+        el.children().not(".post, .topic-status").remove();
+        el.prepend('<div><s style="color: #aaa">已删除</s></div>');
+    });
+    on("reset", function() {
+        // the server has dropped us for being too slow, some events may be lost
+        es.close();
+        notice();
+    });
+}
+
 function _dropdownHeight(el) {
     el = $(el).find("div");
     var diff = el.height() + el.offset().top - $(window).scrollTop() - $(window).height();